@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// OpenC2Actuator executes OpenC2 slpf commands with rules installed by a backend, keeping track of
+// rule numbers, scheduled commands and processed command IDs in the state file
+type OpenC2Actuator struct {
+	Backend   FirewallBackend
+	StateFile string
+	RateLimit float64
+	// RuleDir is the directory local rule files of update commands are read from, empty for none
+	RuleDir   string
+	ruleIdMap map[float64]*FirewallDRule
+	schedule  []*scheduledCommand
+	processed []processedCommand
+	// unmanagedRules are rules not managed by the actuator found by the previous drift check
+	unmanagedRules map[BackendRule]bool
+	lock           sync.Mutex
+}
+
+func NewOpenC2Actuator(backend FirewallBackend) *OpenC2Actuator {
+	return &OpenC2Actuator{Backend: backend, ruleIdMap: make(map[float64]*FirewallDRule)}
+}
+
+// ruleIdsByText maps normalized ingress or egress rule texts of the backend to their rule numbers
+func (act *OpenC2Actuator) ruleIdsByText(egress bool) map[string]float64 {
+	ruleIds := make(map[string]float64)
+	for ruleId, rule := range act.ruleIdMap {
+		if egress && rule.egress() || !egress && rule.ingress() {
+			for _, single := range rule.split() {
+				ruleIds[normalizeRuleText(act.Backend.RuleText(single, egress))] = ruleId
+			}
+		}
+	}
+	return ruleIds
+}
+
+// queryRules answers query for slpf:rule_number or properties ["rules"] with rules active in the backend
+func (act *OpenC2Actuator) queryRules(target openc2.OpenC2Target) (*openc2.OpenC2Response, error) {
+	var wantRuleId float64
+	haveWantRuleId := false
+	switch tgt := target.(type) {
+	case *openc2.TargetSLPFRuleNumber:
+		wantRuleId, haveWantRuleId = float64(*tgt), true
+	case *openc2.TargetProperties:
+		haveRules := false
+		for _, p := range *tgt {
+			if p == "rules" {
+				haveRules = true
+			} else {
+				log.Printf("WARNING: unknown property in query: %#v", p)
+			}
+		}
+		if !haveRules {
+			return nil, UnknownTargetError
+		}
+	default:
+		return nil, UnknownTargetError
+	}
+	activeRules, err := act.Backend.ListRules()
+	if err != nil {
+		return nil, err
+	}
+	ruleIds := map[string]map[string]float64{
+		DirectionIngress: act.ruleIdsByText(false),
+		DirectionEgress:  act.ruleIdsByText(true),
+	}
+	rules := make([]map[string]interface{}, 0)
+	for _, activeRule := range activeRules {
+		ruleInfo := map[string]interface{}{"rule": activeRule.Rule, "direction": activeRule.Direction}
+		ruleId, haveRuleId := ruleIds[activeRule.Direction][normalizeRuleText(activeRule.Rule)]
+		if haveRuleId {
+			ruleInfo["rule_number"] = ruleId
+		}
+		if haveWantRuleId && (!haveRuleId || ruleId != wantRuleId) {
+			continue
+		}
+		rules = append(rules, ruleInfo)
+	}
+	slpfResults := map[string]interface{}{"rules": rules}
+	if haveWantRuleId {
+		if len(rules) == 0 {
+			return nil, InvalidRuleNumber
+		}
+		slpfResults["rule_number"] = wantRuleId
+	}
+	resp := &openc2.OpenC2Response{Status: openc2.StatusOK}
+	resp.AddResults(openc2.SLPFNamespace, slpfResults)
+	return resp, nil
+}
+
+var allowDenyTargets = []openc2.OpenC2TargetType{
+	openc2.TargetTypeIPv4Net,
+	openc2.TargetTypeIPv4Connection,
+	openc2.TargetTypeIPv6Net,
+	openc2.TargetTypeIPv6Connection,
+}
+
+// Features returns results of query for all features supported by the client
+func (act *OpenC2Actuator) Features() map[string]interface{} {
+	features := map[string]interface{}{
+		"versions": []string{"1.0"},
+		"profiles": []string{openc2.SLPFNamespace},
+		"pairs": map[string][]openc2.OpenC2TargetType{
+			"allow":  allowDenyTargets,
+			"deny":   allowDenyTargets,
+			"delete": {openc2.TargetTypeSLPFRuleNumber},
+			"query":  {openc2.TargetTypeFeatures, openc2.TargetTypeProperties, openc2.TargetTypeSLPFRuleNumber},
+			"update": {openc2.TargetTypeFile},
+		},
+	}
+	if act.RateLimit > 0 {
+		features["rate_limit"] = act.RateLimit
+	}
+	return features
+}
+
+func (act *OpenC2Actuator) queryFeatures(features openc2.TargetFeatures) (*openc2.OpenC2Response, error) {
+	all := act.Features()
+	resp := &openc2.OpenC2Response{Status: openc2.StatusOK}
+	for _, f := range features {
+		if all[string(f)] != nil {
+			resp.AddResults(string(f), all[string(f)])
+		} else {
+			log.Printf("WARNING: Unknown feature in query: %#v", f)
+		}
+	}
+	return resp, nil
+}
+
+// ruleFromCommand creates firewall rule from allow/deny command, together with slpf:insert_rule if it was given
+func (act *OpenC2Actuator) ruleFromCommand(oc2cmd *openc2.OpenC2Command) (rule *FirewallDRule, ruleId float64, haveRuleId bool, err error) {
+	var policy FwDPolicy
+	argsSlpf := oc2cmd.Args.SLPF()
+	if argsSlpf == nil {
+		argsSlpf = &openc2.SLPFArgs{}
+	}
+	switch oc2cmd.Action {
+	case openc2.ActionDeny:
+		policy = FwDPolicyReject
+		switch argsSlpf.DropProcess {
+		case "":
+		case openc2.DropProcessNone:
+			policy = FwDPolicyDrop
+		case openc2.DropProcessFalseAck:
+			policy = FwDPolicyRejectFalseAck
+		case openc2.DropProcessReject:
+			policy = FwDPolicyReject
+		default:
+			log.Printf("WARNING: unknown drop_process: %#v", argsSlpf.DropProcess)
+		}
+	case openc2.ActionAllow:
+		policy = FwDPolicyAccept
+	default:
+		return nil, 0, false, UnknownActionError
+	}
+	if argsSlpf.InsertRule != nil {
+		ruleId, haveRuleId = *argsSlpf.InsertRule, true
+	}
+	rule = NewFirewallDRule(policy)
+	rule.persistent = argsSlpf.Persistent
+	capabilities := act.Backend.Capabilities()
+	if rule.persistent && !capabilities.Persistent {
+		return nil, 0, false, PersistentNotSupported
+	}
+	rule.direction = DirectionIngress
+	if capabilities.Egress {
+		rule.direction = DirectionBoth
+	}
+	if direction := argsSlpf.Direction; direction != "" {
+		switch direction {
+		case DirectionIngress, DirectionEgress, DirectionBoth:
+			rule.direction = direction
+		default:
+			return nil, 0, false, openc2.InvalidArgsError
+		}
+		if rule.egress() && !capabilities.Egress {
+			return nil, 0, false, EgressNotSupported
+		}
+	}
+	if err = rule.ProcessOC2Target(oc2cmd.Target); err != nil {
+		log.Printf("Cannot process target %#v: %s", oc2cmd.Target, err)
+		return nil, 0, false, err
+	}
+	if err = rule.validate(capabilities); err != nil {
+		log.Printf("Cannot use target %#v: %s", oc2cmd.Target, err)
+		return nil, 0, false, err
+	}
+	return
+}
+
+// activateRule installs the rule, with backend removing it by itself at stop time if it is set and backend can do it
+func (act *OpenC2Actuator) activateRule(rule *FirewallDRule, stop time.Time) error {
+	timeout := 0
+	if !stop.IsZero() {
+		timeout = int(math.Ceil(time.Until(stop).Seconds()))
+		if timeout < 1 {
+			timeout = 1
+		}
+	}
+	return act.Backend.AddRule(rule, timeout)
+}
+
+func (act *OpenC2Actuator) deleteRuleNumber(tx *transaction, target openc2.OpenC2Target) (*openc2.OpenC2Response, error) {
+	slpfRuleNumber, ok := target.(*openc2.TargetSLPFRuleNumber)
+	if !ok {
+		return nil, UnknownTargetError
+	}
+	slpfRuleNumberInt := float64(*slpfRuleNumber)
+	if act.unscheduleRuleNumber(slpfRuleNumberInt) {
+		return &openc2.OpenC2Response{Status: openc2.StatusOK, StatusText: "Scheduled rule cancelled."}, nil
+	}
+	rule, ok := act.ruleIdMap[slpfRuleNumberInt]
+	if !ok {
+		return nil, InvalidRuleNumber
+	}
+	if err := tx.removeRule(slpfRuleNumberInt, rule); err != nil {
+		return nil, err
+	}
+	return &openc2.OpenC2Response{Status: openc2.StatusOK}, nil
+}
+
+// nextRuleId returns rule number higher than any in use or scheduled
+func (act *OpenC2Actuator) nextRuleId() float64 {
+	var maxRuleId float64
+	for ruleId := range act.ruleIdMap {
+		if ruleId > maxRuleId {
+			maxRuleId = ruleId
+		}
+	}
+	for _, sc := range act.schedule {
+		if sc.RuleNumber > maxRuleId {
+			maxRuleId = sc.RuleNumber
+		}
+	}
+	return math.Floor(maxRuleId) + 1
+}
+
+func (act *OpenC2Actuator) ruleIdInUse(ruleId float64) bool {
+	if _, ok := act.ruleIdMap[ruleId]; ok {
+		return true
+	}
+	for _, sc := range act.schedule {
+		if !sc.Active && sc.RuleNumber == ruleId {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenC2Act executes the command in its own transaction
+func (act *OpenC2Actuator) OpenC2Act(oc2cmd openc2.OpenC2Command) (*openc2.OpenC2Response, error) {
+	responses, errs := act.OpenC2ActBatch([]openc2.OpenC2Command{oc2cmd})
+	return responses[0], errs[0]
+}
+
+// OpenC2ActBatch executes commands in one transaction. If one of them fails, rule changes of all commands are rolled
+// back and the remaining commands are not executed, commands other than queries get BatchRolledBack error.
+func (act *OpenC2Actuator) OpenC2ActBatch(commands []openc2.OpenC2Command) ([]*openc2.OpenC2Response, []error) {
+	responses := make([]*openc2.OpenC2Response, len(commands))
+	errs := make([]error, len(commands))
+	act.lock.Lock()
+	defer act.lock.Unlock()
+	tx := act.beginTransaction()
+	failed := -1
+	for i, oc2cmd := range commands {
+		if responses[i], errs[i] = act.execute(tx, oc2cmd); errs[i] != nil {
+			failed = i
+			break
+		}
+	}
+	var commitErr error
+	if failed < 0 {
+		if commitErr = tx.commit(); commitErr == nil {
+			return responses, errs
+		}
+	} else {
+		tx.rollback()
+	}
+	executed := failed
+	if failed < 0 {
+		executed = len(commands)
+	}
+	for i, oc2cmd := range commands {
+		switch {
+		case i == failed:
+		case i < executed && oc2cmd.Action == openc2.ActionQuery:
+		case commitErr != nil:
+			responses[i], errs[i] = nil, commitErr
+		default:
+			responses[i], errs[i] = nil, BatchRolledBack
+		}
+	}
+	return responses, errs
+}
+
+// execute executes the command, changing rules in transaction tx
+func (act *OpenC2Actuator) execute(tx *transaction, oc2cmd openc2.OpenC2Command) (*openc2.OpenC2Response, error) {
+	log.Printf("Command: %#v", oc2cmd)
+	switch oc2cmd.Action {
+	case openc2.ActionDeny, openc2.ActionAllow:
+	case openc2.ActionDelete:
+		return act.deleteRuleNumber(tx, oc2cmd.Target)
+	case openc2.ActionQuery:
+		if features, ok := oc2cmd.Target.(*openc2.TargetFeatures); ok {
+			return act.queryFeatures(*features)
+		}
+		return act.queryRules(oc2cmd.Target)
+	case openc2.ActionUpdate:
+		return act.updateFile(tx, oc2cmd.Target)
+	default:
+		log.Printf("Don't know what to do with action %#v", oc2cmd.Action)
+		return nil, UnknownActionError
+	}
+	rule, ruleId, haveRuleId, err := act.ruleFromCommand(&oc2cmd)
+	if err != nil {
+		return nil, err
+	}
+	if !haveRuleId {
+		ruleId = act.nextRuleId()
+	} else if act.ruleIdInUse(ruleId) {
+		return nil, RuleNumberInUse
+	}
+	start, stop, err := oc2cmd.TemporalArgs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !stop.IsZero() && !stop.After(now) {
+		log.Printf("Command stop time %s already passed", stop)
+		return nil, openc2.InvalidArgsError
+	}
+	resp := &openc2.OpenC2Response{Status: openc2.StatusOK}
+	resp.AddResults(openc2.SLPFNamespace, map[string]interface{}{"rule_number": ruleId})
+	if start.After(now) {
+		if err := act.scheduleCommand(&scheduledCommand{Command: &oc2cmd, RuleNumber: ruleId, StartTime: start, StopTime: stop}); err != nil {
+			return nil, err
+		}
+		resp.StatusText = fmt.Sprintf("Rule scheduled for %s", start.Format(time.RFC3339))
+		return resp, nil
+	}
+	if err := tx.addRule(ruleId, rule, stop); err != nil {
+		return nil, err
+	}
+	if !stop.IsZero() {
+		act.schedule = append(act.schedule, &scheduledCommand{Command: &oc2cmd, RuleNumber: ruleId, StartTime: now, StopTime: stop, Active: true})
+	}
+	return resp, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "strings"
+
+// FirewallBackend installs rules of the actuator into the packet filter of the host
+type FirewallBackend interface {
+	// AddRule installs all parts of the rule, removing already installed parts if one fails.
+	// With timeout > 0 a backend with Timeout capability removes the runtime ingress rule by itself after timeout seconds.
+	AddRule(rule *FirewallDRule, timeout int) error
+	// RemoveRule removes all parts of the rule, trying to remove the rest if one fails
+	RemoveRule(rule *FirewallDRule) error
+	// ListRules returns rules active in the packet filter, including ones not installed by the actuator
+	ListRules() ([]BackendRule, error)
+	// RuleText returns ingress or egress part of the rule the way ListRules lists it. Rule with multiple port ranges
+	// is installed as several rules, RuleText is called with each of them, see FirewallDRule.split.
+	RuleText(rule *FirewallDRule, egress bool) string
+	Capabilities() BackendCapabilities
+}
+
+// ChangeNotifier is implemented by backends which can tell when rules may have been changed by someone else
+type ChangeNotifier interface {
+	// NotifyChanges calls changed with the reason whenever rules might have been changed outside of the actuator
+	NotifyChanges(changed func(reason string)) error
+}
+
+// BackendRule is a rule active in the packet filter, in backend's own syntax
+type BackendRule struct {
+	Rule      string
+	Direction string
+}
+
+type BackendCapabilities struct {
+	// Egress rules for outgoing traffic can be installed
+	Egress bool
+	// Persistent rules survive restart of the packet filter
+	Persistent bool
+	// Timeout of runtime ingress rules is handled by the packet filter itself
+	Timeout bool
+	// SourceAndDestinationPort can be matched in the same rule
+	SourceAndDestinationPort bool
+	// ICMPType of icmp protocol can be matched
+	ICMPType bool
+}
+
+// setPolicies are policies of address sets, backends keep addresses of ipv4_net/ipv6_net rules in one set per policy
+var setPolicies = []FwDPolicy{FwDPolicyDrop, FwDPolicyReject, FwDPolicyRejectFalseAck, FwDPolicyAccept}
+
+var setPolicyNames = map[FwDPolicy]string{
+	FwDPolicyAccept:         "accept",
+	FwDPolicyDrop:           "drop",
+	FwDPolicyReject:         "reject",
+	FwDPolicyRejectFalseAck: "reset",
+}
+
+// normalizeRuleText collapses whitespace so rules generated here can be compared to the ones listed by backend
+func normalizeRuleText(rule string) string {
+	return strings.Join(strings.Fields(rule), " ")
+}
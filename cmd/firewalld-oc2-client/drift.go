@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// reinstallMissingRules reinstalls managed rules which are not listed by backend, returning the missing parts with
+// the outcome of reinstalling in "reinstalled" (and "error" if it failed), and rules listed by backend which are not
+// managed and have not been seen in earlier checks. Rules past their stop time are left for the scheduler to forget.
+func (act *OpenC2Actuator) reinstallMissingRules() (missing, unmanaged []map[string]interface{}, err error) {
+	activeRules, err := act.Backend.ListRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	listed := map[string]map[string]bool{DirectionIngress: {}, DirectionEgress: {}}
+	for _, activeRule := range activeRules {
+		if listed[activeRule.Direction] != nil {
+			listed[activeRule.Direction][normalizeRuleText(activeRule.Rule)] = true
+		}
+	}
+	unmanaged = act.newUnmanagedRules(activeRules)
+	stops := make(map[float64]time.Time)
+	for _, sc := range act.schedule {
+		if sc.Active {
+			stops[sc.RuleNumber] = sc.StopTime
+		}
+	}
+	now := time.Now()
+	for ruleId, rule := range act.ruleIdMap {
+		stop := stops[ruleId]
+		if !stop.IsZero() && !stop.After(now) {
+			continue
+		}
+		var missingParts []map[string]interface{}
+		for _, egress := range []bool{false, true} {
+			if egress && !rule.egress() || !egress && !rule.ingress() {
+				continue
+			}
+			direction := DirectionIngress
+			if egress {
+				direction = DirectionEgress
+			}
+			for _, single := range rule.split() {
+				text := act.Backend.RuleText(single, egress)
+				if !listed[direction][normalizeRuleText(text)] {
+					missingParts = append(missingParts, map[string]interface{}{"rule": text, "direction": direction, "rule_number": ruleId})
+				}
+			}
+		}
+		if len(missingParts) == 0 {
+			continue
+		}
+		// parts still present would make adding fail, so the rule is removed and added again as a whole
+		log.Printf("Rule %v has %d parts missing, reinstalling: %s", ruleId, len(missingParts), rule)
+		if err := act.Backend.RemoveRule(rule); err != nil {
+			log.Printf("Removing rest of rule %v: %s", ruleId, err)
+		}
+		reinstallErr := act.activateRule(rule, stop)
+		if reinstallErr != nil {
+			log.Printf("Could not reinstall rule %v %s: %s", ruleId, rule, reinstallErr)
+		}
+		for _, part := range missingParts {
+			part["reinstalled"] = reinstallErr == nil
+			if reinstallErr != nil {
+				part["error"] = reinstallErr.Error()
+			}
+		}
+		missing = append(missing, missingParts...)
+	}
+	return missing, unmanaged, nil
+}
+
+// newUnmanagedRules returns active rules not managed by the actuator which were not there at the previous check.
+// All unmanaged rules are returned at the first check.
+func (act *OpenC2Actuator) newUnmanagedRules(activeRules []BackendRule) (ret []map[string]interface{}) {
+	managed := map[string]map[string]float64{
+		DirectionIngress: act.ruleIdsByText(false),
+		DirectionEgress:  act.ruleIdsByText(true),
+	}
+	seen := make(map[BackendRule]bool)
+	for _, activeRule := range activeRules {
+		text := normalizeRuleText(activeRule.Rule)
+		if _, ok := managed[activeRule.Direction][text]; ok {
+			continue
+		}
+		key := BackendRule{Rule: text, Direction: activeRule.Direction}
+		seen[key] = true
+		if !act.unmanagedRules[key] {
+			ret = append(ret, map[string]interface{}{"rule": activeRule.Rule, "direction": activeRule.Direction})
+		}
+	}
+	act.unmanagedRules = seen
+	return
+}
+
+// RunReconciler reinstalls missing managed rules every interval (if not 0) and after backend reports a change,
+// passing report about reinstalled rules to report. Never returns.
+func (act *OpenC2Actuator) RunReconciler(interval time.Duration, report func(*openc2.OpenC2Response)) {
+	changed := make(chan string, 1)
+	if notifier, ok := act.Backend.(ChangeNotifier); ok {
+		err := notifier.NotifyChanges(func(reason string) {
+			select {
+			case changed <- reason:
+			default:
+			}
+		})
+		if err != nil {
+			log.Printf("WARNING: changes of rules are not noticed before periodic check: %s", err)
+		}
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		reason := "periodic check"
+		select {
+		case <-tick:
+		case reason = <-changed:
+			// let related changes, like removal of several rules, settle
+			time.Sleep(time.Second)
+			select {
+			case <-changed:
+			default:
+			}
+		}
+		act.lock.Lock()
+		missing, unmanaged, err := act.reinstallMissingRules()
+		act.lock.Unlock()
+		if err != nil {
+			log.Printf("Could not reconcile rules: %s", err)
+			continue
+		}
+		if len(missing) == 0 && len(unmanaged) == 0 {
+			continue
+		}
+		failed := 0
+		for _, part := range missing {
+			if part["reinstalled"] == false {
+				failed++
+			}
+		}
+		log.Printf("Found %d missing rule parts (%d not reinstalled) and %d new unmanaged rules after %s",
+			len(missing), failed, len(unmanaged), reason)
+		if report != nil {
+			resp := &openc2.OpenC2Response{Status: openc2.StatusOK,
+				StatusText: fmt.Sprintf("Rules changed outside of OpenC2 (%s): %d managed rules missing, %d could not be reinstalled, %d unmanaged rules added",
+					reason, len(missing), failed, len(unmanaged))}
+			results := map[string]interface{}{}
+			if len(missing) != 0 {
+				results["rules"] = missing
+			}
+			if len(unmanaged) != 0 {
+				results["unmanaged"] = unmanaged
+			}
+			resp.AddResults(openc2.SLPFNamespace, results)
+			report(resp)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/godbus/dbus"
 	"github.com/korc/openc2-firewalld"
@@ -10,6 +11,7 @@ import (
 
 const fwd1Interface = "org.fedoraproject.FirewallD1"
 const fwd1Path = "/org/fedoraproject/FirewallD1"
+const fwd1ConfigPath = fwd1Path + "/config"
 
 type FwDPolicy string
 
@@ -20,76 +22,237 @@ const (
 	FwDPolicyRejectFalseAck FwDPolicy = "reject type=\"tcp-reset\""
 )
 
+const (
+	DirectionIngress = "ingress"
+	DirectionEgress  = "egress"
+	DirectionBoth    = "both"
+)
+
+// FirewallDControl is backend installing rules as rich rules of a firewalld zone and egress policy over D-Bus
 type FirewallDControl struct {
-	Connection *dbus.Conn
-	FwD1       dbus.BusObject
-	Zone       string
-	ruleIdMap  map[float64]*FirewallDRule
+	Connection   *dbus.Conn
+	FwD1         dbus.BusObject
+	Zone         string
+	EgressPolicy string
+	// IPSetPrefix is prefix of ipsets for addresses of ipv4_net/ipv6_net rules, empty to add them as rich rules
+	IPSetPrefix string
 }
 
 type FirewallDRule struct {
 	policy             FwDPolicy
 	family             string
-	sourcePort         int
-	destinationPort    int
+	sourcePort         openc2.Ports
+	destinationPort    openc2.Ports
 	sourceAddress      string
 	destinationAddress string
 	protocol           string
+	icmpType           string
 	dropProcess        string
+	persistent         bool
+	direction          string
+	netTarget          bool
 }
 
 func NewFirewallDRule(policy FwDPolicy) *FirewallDRule {
 	return &FirewallDRule{policy: policy}
 }
 
+// ingress returns true if rule applies to incoming traffic, rules without direction are ingress-only
+func (fwr *FirewallDRule) ingress() bool {
+	return fwr.direction == "" || fwr.direction == DirectionIngress || fwr.direction == DirectionBoth
+}
+
+func (fwr *FirewallDRule) egress() bool {
+	return fwr.direction == DirectionEgress || fwr.direction == DirectionBoth
+}
+
 func (fwr *FirewallDRule) String() string {
-	ruleParts := []string{"rule"}
-	if fwr.sourceAddress != "" {
-		ruleParts = append(ruleParts, fmt.Sprintf("source address=\"%s\"", fwr.sourceAddress))
+	return fwr.richRule(!fwr.ingress())
+}
+
+// portVariants returns single port ranges of ports, or nil if there are no ports
+func portVariants(ports openc2.Ports) []openc2.Ports {
+	if len(ports) == 0 {
+		return []openc2.Ports{nil}
 	}
-	if fwr.sourcePort != 0 {
-		ruleParts = append(ruleParts, fmt.Sprintf("source-port port=\"%d\"", fwr.sourcePort))
-		ruleParts = append(ruleParts, fmt.Sprintf("protocol=\"%s\"", fwr.protocol))
+	ret := make([]openc2.Ports, len(ports))
+	for i, r := range ports {
+		ret[i] = openc2.Ports{r}
 	}
-	if fwr.destinationAddress != "" {
-		ruleParts = append(ruleParts, fmt.Sprintf("destination address=\"%s\"", fwr.destinationAddress))
+	return ret
+}
+
+// split returns rules with at most one source and one destination port range each, as one rich rule (or
+// nftables/iptables rule) can match only a single range. Rule without multiple ranges is returned as is.
+func (fwr *FirewallDRule) split() []*FirewallDRule {
+	if len(fwr.sourcePort) <= 1 && len(fwr.destinationPort) <= 1 {
+		return []*FirewallDRule{fwr}
 	}
-	if fwr.destinationPort != 0 {
-		ruleParts = append(ruleParts, fmt.Sprintf("port port=\"%d\"", fwr.destinationPort))
-		ruleParts = append(ruleParts, fmt.Sprintf("protocol=\"%s\"", fwr.protocol))
+	var ret []*FirewallDRule
+	for _, sourcePort := range portVariants(fwr.sourcePort) {
+		for _, destinationPort := range portVariants(fwr.destinationPort) {
+			rule := *fwr
+			rule.sourcePort, rule.destinationPort = sourcePort, destinationPort
+			ret = append(ret, &rule)
+		}
 	}
+	return ret
+}
+
+// richRule returns rule for the zone (incoming traffic) or egress policy (outgoing traffic), rule with multiple
+// port ranges needs to be split first.
+// Address of ipv4_net/ipv6_net target is matched as source address in the zone and as destination in the policy.
+func (fwr *FirewallDRule) richRule(egress bool) string {
+	ruleParts := []string{"rule"}
 	if fwr.family != "" {
 		ruleParts = append(ruleParts, fmt.Sprintf("family=\"%s\"", fwr.family))
 	}
+	if fwr.netTarget && egress {
+		ruleParts = append(ruleParts, fmt.Sprintf("destination address=\"%s\"", fwr.sourceAddress))
+	} else if fwr.sourceAddress != "" {
+		ruleParts = append(ruleParts, fmt.Sprintf("source address=\"%s\"", fwr.sourceAddress))
+	}
+	if fwr.destinationAddress != "" {
+		ruleParts = append(ruleParts, fmt.Sprintf("destination address=\"%s\"", fwr.destinationAddress))
+	}
+	if element := fwr.richRuleElement(); element != "" {
+		ruleParts = append(ruleParts, element)
+	}
 	ruleParts = append(ruleParts, string(fwr.policy))
 	return strings.Join(ruleParts, " ")
 }
 
-func (fwr *FirewallDRule) ProcessOC2Target(target interface{}) error {
+// richRuleElement returns the only element rich rule can have, matching ICMP type, port or protocol
+func (fwr *FirewallDRule) richRuleElement() string {
+	switch {
+	case fwr.icmpType != "":
+		return fmt.Sprintf("icmp-type name=\"%s\"", fwr.icmpType)
+	case len(fwr.destinationPort) != 0:
+		return fmt.Sprintf("port port=\"%s\" protocol=\"%s\"", fwr.destinationPort, fwr.protocol)
+	case len(fwr.sourcePort) != 0:
+		return fmt.Sprintf("source-port port=\"%s\" protocol=\"%s\"", fwr.sourcePort, fwr.protocol)
+	case fwr.protocol != "":
+		return fmt.Sprintf("protocol value=\"%s\"", fwr.familyProtocol())
+	}
+	return ""
+}
+
+// familyProtocol returns name of the protocol for the rule family, ICMP being ipv6-icmp in ipv6
+func (fwr *FirewallDRule) familyProtocol() string {
+	if fwr.protocol == "icmp" && fwr.family == "ipv6" {
+		return "ipv6-icmp"
+	}
+	return fwr.protocol
+}
+
+// portProtocols are protocols which can be matched by port
+var portProtocols = map[string]bool{"tcp": true, "udp": true, "sctp": true}
+
+// validate checks that the rule can be installed by backend with the capabilities
+func (fwr *FirewallDRule) validate(capabilities BackendCapabilities) error {
+	if fwr.protocol != "" && !portProtocols[fwr.protocol] && fwr.protocol != "icmp" {
+		return &InvalidRuleError{fmt.Sprintf("unknown protocol %#v", fwr.protocol)}
+	}
+	if (len(fwr.sourcePort) != 0 || len(fwr.destinationPort) != 0) && !portProtocols[fwr.protocol] {
+		return &InvalidRuleError{"ports can be matched only with tcp, udp or sctp protocol"}
+	}
+	if len(fwr.sourcePort) != 0 && len(fwr.destinationPort) != 0 && !capabilities.SourceAndDestinationPort {
+		return &InvalidRuleError{"source and destination ports can't be matched in the same rule"}
+	}
+	if fwr.icmpType != "" {
+		if fwr.protocol != "icmp" {
+			return &InvalidRuleError{"icmp_type can be matched only with icmp protocol"}
+		}
+		if !capabilities.ICMPType {
+			return ICMPTypeNotSupported
+		}
+	}
+	if fwr.policy == FwDPolicyRejectFalseAck && fwr.protocol != "" && fwr.protocol != "tcp" {
+		return &InvalidRuleError{"false_ack can be sent only in response to tcp"}
+	}
+	return nil
+}
+
+// firewallDRuleJSON is the representation of FirewallDRule in client state file
+type firewallDRuleJSON struct {
+	Policy             FwDPolicy    `json:"policy"`
+	Family             string       `json:"family,omitempty"`
+	SourcePort         openc2.Ports `json:"src_port,omitempty"`
+	DestinationPort    openc2.Ports `json:"dst_port,omitempty"`
+	SourceAddress      string       `json:"src_addr,omitempty"`
+	DestinationAddress string       `json:"dst_addr,omitempty"`
+	Protocol           string       `json:"protocol,omitempty"`
+	ICMPType           string       `json:"icmp_type,omitempty"`
+	Persistent         bool         `json:"persistent,omitempty"`
+	Direction          string       `json:"direction,omitempty"`
+	NetTarget          bool         `json:"net_target,omitempty"`
+}
+
+func (fwr *FirewallDRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(firewallDRuleJSON{
+		Policy:             fwr.policy,
+		Family:             fwr.family,
+		SourcePort:         fwr.sourcePort,
+		DestinationPort:    fwr.destinationPort,
+		SourceAddress:      fwr.sourceAddress,
+		DestinationAddress: fwr.destinationAddress,
+		Protocol:           fwr.protocol,
+		ICMPType:           fwr.icmpType,
+		Persistent:         fwr.persistent,
+		Direction:          fwr.direction,
+		NetTarget:          fwr.netTarget,
+	})
+}
+
+func (fwr *FirewallDRule) UnmarshalJSON(b []byte) error {
+	var x firewallDRuleJSON
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	*fwr = FirewallDRule{
+		policy:             x.Policy,
+		family:             x.Family,
+		sourcePort:         x.SourcePort,
+		destinationPort:    x.DestinationPort,
+		sourceAddress:      x.SourceAddress,
+		destinationAddress: x.DestinationAddress,
+		protocol:           x.Protocol,
+		icmpType:           x.ICMPType,
+		persistent:         x.Persistent,
+		direction:          x.Direction,
+		netTarget:          x.NetTarget,
+	}
+	return nil
+}
+
+func (fwr *FirewallDRule) ProcessOC2Target(target openc2.OpenC2Target) error {
+	var connection *openc2.TargetIPConnection
 	switch tgt := target.(type) {
 	case *openc2.TargetIPv6Connection:
 		fwr.family = "ipv6"
-		target = &tgt.TargetIPConnection
+		connection = &tgt.TargetIPConnection
 	case *openc2.TargetIPv4Connection:
 		fwr.family = "ipv4"
-		target = &tgt.TargetIPConnection
-	}
-	switch tgt := target.(type) {
-	case *openc2.TargetIPConnection:
-		fwr.sourceAddress = tgt.SourceAddress
-		fwr.destinationAddress = tgt.DestinationAddress
-		fwr.protocol = tgt.Protocol
-		fwr.sourcePort = tgt.SourcePort
-		fwr.destinationPort = tgt.DestinationPort
+		connection = &tgt.TargetIPConnection
 	case *openc2.TargetIPv6Net:
 		fwr.family = "ipv6"
-		fwr.sourceAddress = string(*tgt)
+		fwr.sourceAddress = normalizeAddress(string(*tgt))
+		fwr.netTarget = true
 	case *openc2.TargetIPv4Net:
 		fwr.family = "ipv4"
-		fwr.sourceAddress = string(*tgt)
+		fwr.sourceAddress = normalizeAddress(string(*tgt))
+		fwr.netTarget = true
 	default:
 		return UnknownTargetError
 	}
+	if connection != nil {
+		fwr.sourceAddress = connection.SourceAddress
+		fwr.destinationAddress = connection.DestinationAddress
+		fwr.protocol = connection.Protocol
+		fwr.icmpType = connection.ICMPType
+		fwr.sourcePort = connection.SourcePort
+		fwr.destinationPort = connection.DestinationPort
+	}
 	return nil
 }
 
@@ -106,105 +269,184 @@ func NewFirewallDControl() (*FirewallDControl, error) {
 	if err = ret.FwD1.Call(fwd1Interface+".getDefaultZone", 0).Store(&ret.Zone); err != nil {
 		return nil, err
 	}
-	ret.ruleIdMap = make(map[float64]*FirewallDRule)
 
 	return ret, nil
 }
 
-func (fwd *FirewallDControl) RemoveIC2Rule(rule *FirewallDRule) (callRet string, err error) {
-	log.Printf("Removing rule: %s", rule)
-	if err = fwd.FwD1.Call(fwd1Interface+".zone.removeRichRule", 0, fwd.Zone, rule.String()).Store(&callRet); err != nil {
-		log.Printf("Could not remove rule %#v: %s", rule, err)
-		return callRet, err
+// GetRichRules returns rich rules currently active in the zone
+func (fwd *FirewallDControl) GetRichRules() (rules []string, err error) {
+	if err = fwd.FwD1.Call(fwd1Interface+".zone.getRichRules", 0, fwd.Zone).Store(&rules); err != nil {
+		log.Printf("Could not get rich rules of zone %#v: %s", fwd.Zone, err)
 	}
-	return callRet, nil
+	return
 }
 
-func (fwd *FirewallDControl) AddIC2Rule(rule *FirewallDRule) (string, error) {
-	var callRet string
-	log.Printf("Adding rule: %s", rule)
-	if err := fwd.FwD1.Call(fwd1Interface+".zone.addRichRule", 0, fwd.Zone, rule.String(), 0).Store(&callRet); err != nil {
-		log.Printf("Adding rich rule %#v failed: %s", rule, err)
-		return callRet, err
+// ListRules returns rich rules active in the zone and egress policy, and addresses in ipsets as rich rules
+func (fwd *FirewallDControl) ListRules() ([]BackendRule, error) {
+	zoneRules, err := fwd.GetRichRules()
+	if err != nil {
+		return nil, err
+	}
+	var rules []BackendRule
+	for _, rule := range zoneRules {
+		rules = append(rules, BackendRule{Rule: rule, Direction: DirectionIngress})
+	}
+	if fwd.EgressPolicy != "" {
+		policyRules, err := fwd.GetPolicyRichRules()
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range policyRules {
+			rules = append(rules, BackendRule{Rule: rule, Direction: DirectionEgress})
+		}
+	}
+	if fwd.IPSetPrefix != "" {
+		ipsetRules, err := fwd.ipsetRules()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, ipsetRules...)
 	}
-	return callRet, nil
+	return rules, nil
 }
 
-func (fwd *FirewallDControl) OpenC2Act(oc2cmd openc2.OpenC2Command) error {
-	log.Printf("Command: %#v", oc2cmd)
-	var policy FwDPolicy
-	var ruleId float64
-	haveRuleId := false
-	argsSlpf := make(map[string]interface{})
-	if args, ok := oc2cmd.Args.(map[string]interface{}); ok {
-		if slpf, ok := args["slpf"]; ok {
-			if slpfMap, ok := slpf.(map[string]interface{}); ok {
-				argsSlpf = slpfMap
-			}
+func (fwd *FirewallDControl) RuleText(rule *FirewallDRule, egress bool) string {
+	return rule.richRule(egress)
+}
+
+func (fwd *FirewallDControl) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Egress: fwd.EgressPolicy != "", Persistent: true, Timeout: true, ICMPType: true}
+}
+
+// configZone returns object of the zone in firewalld permanent configuration
+func (fwd *FirewallDControl) configZone() (dbus.BusObject, error) {
+	var zonePath dbus.ObjectPath
+	if err := fwd.Connection.Object(fwd1Interface, fwd1ConfigPath).Call(fwd1Interface+".config.getZoneByName", 0, fwd.Zone).Store(&zonePath); err != nil {
+		return nil, err
+	}
+	return fwd.Connection.Object(fwd1Interface, zonePath), nil
+}
+
+func (fwd *FirewallDControl) addPermanentRule(richRule string) error {
+	zone, err := fwd.configZone()
+	if err != nil {
+		return err
+	}
+	log.Printf("Adding permanent rule: %s", richRule)
+	return zone.Call(fwd1Interface+".config.zone.addRichRule", 0, richRule).Err
+}
+
+func (fwd *FirewallDControl) removePermanentRule(richRule string) error {
+	zone, err := fwd.configZone()
+	if err != nil {
+		return err
+	}
+	log.Printf("Removing permanent rule: %s", richRule)
+	return zone.Call(fwd1Interface+".config.zone.removeRichRule", 0, richRule).Err
+}
+
+// rulePart is ingress or egress, runtime or permanent part of a rule
+type rulePart struct {
+	egress    bool
+	permanent bool
+}
+
+func (part rulePart) String() string {
+	ret := "runtime"
+	if part.permanent {
+		ret = "permanent"
+	}
+	if part.egress {
+		ret += " egress"
+	}
+	return ret
+}
+
+// ruleParts returns parts of the rule in the order they are added
+func ruleParts(rule *FirewallDRule) (parts []rulePart) {
+	for _, egress := range []bool{false, true} {
+		if egress && !rule.egress() || !egress && !rule.ingress() {
+			continue
+		}
+		parts = append(parts, rulePart{egress: egress})
+		if rule.persistent {
+			parts = append(parts, rulePart{egress: egress, permanent: true})
 		}
 	}
-	switch oc2cmd.Action {
-	case openc2.ActionDeny:
-		policy = FwDPolicyReject
-		if dropProcess, ok := argsSlpf["drop_process"]; ok {
-			switch dropProcess {
-			case "none":
-				policy = FwDPolicyDrop
-			case "false_ack":
-				policy = FwDPolicyRejectFalseAck
-			case "reject":
-				policy = FwDPolicyReject
-			default:
-				log.Printf("WARNING: unknown drop_process: %#v", dropProcess)
-			}
+	return
+}
+
+// addPart adds part of the rule to ipset, zone or egress policy, timeout applies to runtime zone rule only
+func (fwd *FirewallDControl) addPart(rule *FirewallDRule, part rulePart, timeout int) error {
+	if fwd.usesIPSet(rule, timeout) {
+		return fwd.updateIPSetEntry(fwd.ipsetName(part.egress, rule.policy, rule.family), rule.sourceAddress, true, part.permanent)
+	}
+	richRule := rule.richRule(part.egress)
+	switch {
+	case part.egress:
+		return fwd.updatePolicyRichRule(richRule, true, part.permanent)
+	case part.permanent:
+		return fwd.addPermanentRule(richRule)
+	}
+	return fwd.FwD1.Call(fwd1Interface+".zone.addRichRule", 0, fwd.Zone, richRule, timeout).Err
+}
+
+// removePart removes part of the rule from ipset if it is there, from zone or egress policy otherwise
+func (fwd *FirewallDControl) removePart(rule *FirewallDRule, part rulePart) error {
+	if fwd.usesIPSet(rule, 0) {
+		name := fwd.ipsetName(part.egress, rule.policy, rule.family)
+		found, err := fwd.queryIPSetEntry(name, rule.sourceAddress, part.permanent)
+		if err != nil {
+			return err
 		}
-		if insertRule, ok := argsSlpf["insert_rule"]; ok {
-			if insertRuleFloat, ok := insertRule.(float64); ok {
-				ruleId = insertRuleFloat
-				haveRuleId = true
-			}
+		if found {
+			return fwd.updateIPSetEntry(name, rule.sourceAddress, false, part.permanent)
 		}
-	case openc2.ActionAllow:
-		policy = FwDPolicyAccept
-	case openc2.ActionDelete:
-		if target, ok := oc2cmd.Target.(openc2.OpenC2GenericTarget); ok {
-			if slpfRuleNumber, ok := target["slpf:rule_number"]; ok {
-				if slpfRuleNumberInt, ok := slpfRuleNumber.(float64); ok {
-					if rule, ok := fwd.ruleIdMap[slpfRuleNumberInt]; ok {
-						if callret, err := fwd.RemoveIC2Rule(rule); err != nil {
-							return err
-						} else {
-							log.Printf("Removing rule OK: %s", callret)
-							delete(fwd.ruleIdMap, slpfRuleNumberInt)
-							return nil
-						}
-					} else {
-						return InvalidRuleNumber
-					}
-				} else {
-					return UnknownTargetError
+	}
+	richRule := rule.richRule(part.egress)
+	switch {
+	case part.egress:
+		return fwd.updatePolicyRichRule(richRule, false, part.permanent)
+	case part.permanent:
+		return fwd.removePermanentRule(richRule)
+	}
+	return fwd.FwD1.Call(fwd1Interface+".zone.removeRichRule", 0, fwd.Zone, richRule).Err
+}
+
+// RemoveRule removes all parts of the rule, trying to remove the rest if one fails
+func (fwd *FirewallDControl) RemoveRule(rule *FirewallDRule) (err error) {
+	log.Printf("Removing rule: %s (direction=%#v)", rule, rule.direction)
+	for _, r := range rule.split() {
+		for _, part := range ruleParts(r) {
+			if e := fwd.removePart(r, part); e != nil {
+				log.Printf("Could not remove %s rule %#v: %s", part, r, e)
+				if err == nil {
+					err = e
 				}
-			} else {
-				return UnknownTargetError
 			}
-		} else {
-			return UnknownTargetError
 		}
-	default:
-		log.Printf("Don't know what to do with action %#v", oc2cmd.Action)
-		return UnknownActionError
-	}
-	rule := NewFirewallDRule(policy)
-	if err := rule.ProcessOC2Target(oc2cmd.Target); err != nil {
-		log.Printf("Cannot process target %#v: %s", oc2cmd.Target, err)
-		return err
 	}
-	if res, err := fwd.AddIC2Rule(rule); err != nil {
-		return err
-	} else {
-		log.Printf("Action done: %#v", res)
-		if haveRuleId {
-			fwd.ruleIdMap[ruleId] = rule
+	return err
+}
+
+// AddRule installs all parts of the rule, removing already installed parts if one fails.
+// Timeout is used for runtime zone rule only, egress and permanent rules need to be removed by the caller.
+func (fwd *FirewallDControl) AddRule(rule *FirewallDRule, timeout int) error {
+	var undo []func() error
+	log.Printf("Adding rule: %s (direction=%#v, timeout=%d)", rule, rule.direction, timeout)
+	for _, r := range rule.split() {
+		for _, part := range ruleParts(r) {
+			if err := fwd.addPart(r, part, timeout); err != nil {
+				log.Printf("Adding %s rule %#v failed: %s", part, r, err)
+				for i := len(undo) - 1; i >= 0; i-- {
+					if err := undo[i](); err != nil {
+						log.Printf("Could not roll back part of rule %#v: %s", rule, err)
+					}
+				}
+				return err
+			}
+			r, part := r, part
+			undo = append(undo, func() error { return fwd.removePart(r, part) })
 		}
 	}
 	return nil
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/godbus/dbus"
+)
+
+// With IPSetPrefix set, addresses of ipv4_net/ipv6_net rules without timeout are added to firewalld ipsets, one per
+// direction, policy and family, each referenced by a single rich rule of the zone or egress policy. Runtime ipsets
+// can only be created through permanent configuration and a reload, which the admin has to do after first start.
+// Rules with timeout stay as separate rich rules, as only those are expired by firewalld, and so do addresses with
+// zero prefix length, which hash:net ipsets can't hold.
+
+// ipsetSettings is the settings structure of firewalld ipset
+type ipsetSettings struct {
+	Version     string
+	Short       string
+	Description string
+	Type        string
+	Options     map[string]string
+	Entries     []string
+}
+
+// fwdIPSet is ipset for addresses of rules with the same direction, policy and family
+type fwdIPSet struct {
+	name   string
+	egress bool
+	policy FwDPolicy
+	family string
+}
+
+func (fwd *FirewallDControl) ipsetName(egress bool, policy FwDPolicy, family string) string {
+	direction, familyNumber := "in", "4"
+	if egress {
+		direction = "out"
+	}
+	if family == "ipv6" {
+		familyNumber = "6"
+	}
+	return fmt.Sprintf("%s-%s-%s-%s", fwd.IPSetPrefix, direction, setPolicyNames[policy], familyNumber)
+}
+
+// ipsets returns all ipsets used, egress ones only if egress policy is set
+func (fwd *FirewallDControl) ipsets() (ret []fwdIPSet) {
+	for _, egress := range []bool{false, true} {
+		if egress && fwd.EgressPolicy == "" {
+			continue
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, policy := range setPolicies {
+				ret = append(ret, fwdIPSet{name: fwd.ipsetName(egress, policy, family), egress: egress, policy: policy, family: family})
+			}
+		}
+	}
+	return
+}
+
+// richRule returns rich rule matching the ipset, source address in the zone and destination in the egress policy
+func (set fwdIPSet) richRule() string {
+	match := "source"
+	if set.egress {
+		match = "destination"
+	}
+	return fmt.Sprintf("rule family=\"%s\" %s ipset=\"%s\" %s", set.family, match, set.name, set.policy)
+}
+
+// ipsetAddress returns true if address can be an entry of hash:net ipset, which rejects /0 networks
+func ipsetAddress(address string) bool {
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		ones, _ := network.Mask.Size()
+		return ones > 0
+	}
+	return net.ParseIP(address) != nil
+}
+
+// usesIPSet returns true if address of the rule is kept in ipset instead of a separate rich rule
+func (fwd *FirewallDControl) usesIPSet(rule *FirewallDRule, timeout int) bool {
+	return fwd.IPSetPrefix != "" && rule.netTarget && timeout == 0 && ipsetAddress(rule.sourceAddress)
+}
+
+// EnsureIPSets checks that all ipsets are active and adds rich rules matching them to the zone and egress policy.
+// Missing ipsets are created in permanent configuration, but firewalld is not reloaded, as that would flush runtime
+// rules of other tools: it is up to the admin to reload.
+func (fwd *FirewallDControl) EnsureIPSets() error {
+	var ipsetNames []string
+	if err := fwd.FwD1.Call(fwd1Interface+".ipset.getIPSets", 0).Store(&ipsetNames); err != nil {
+		return err
+	}
+	active := make(map[string]bool)
+	for _, name := range ipsetNames {
+		active[name] = true
+	}
+	config := fwd.Connection.Object(fwd1Interface, fwd1ConfigPath)
+	if err := config.Call(fwd1Interface+".config.getIPSetNames", 0).Store(&ipsetNames); err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, name := range ipsetNames {
+		existing[name] = true
+	}
+	inactive := 0
+	for _, set := range fwd.ipsets() {
+		if active[set.name] {
+			continue
+		}
+		inactive++
+		if existing[set.name] {
+			continue
+		}
+		family := "inet"
+		if set.family == "ipv6" {
+			family = "inet6"
+		}
+		settings := ipsetSettings{
+			Short:       "OpenC2 " + setPolicyNames[set.policy],
+			Description: "Addresses of rules managed by firewalld-oc2-client",
+			Type:        "hash:net",
+			Options:     map[string]string{"family": family},
+			Entries:     []string{},
+		}
+		log.Printf("Creating ipset %#v in permanent configuration", set.name)
+		var ipsetPath dbus.ObjectPath
+		if err := config.Call(fwd1Interface+".config.addIPSet", 0, set.name, settings).Store(&ipsetPath); err != nil {
+			return err
+		}
+	}
+	if inactive != 0 {
+		return fmt.Errorf("%d ipsets are not active, reload firewalld to activate them", inactive)
+	}
+	zone, err := fwd.configZone()
+	if err != nil {
+		return err
+	}
+	for _, set := range fwd.ipsets() {
+		richRule := set.richRule()
+		if set.egress {
+			for _, permanent := range []bool{false, true} {
+				if err := fwd.updatePolicyRichRule(richRule, true, permanent); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		var enabled bool
+		if err := fwd.FwD1.Call(fwd1Interface+".zone.queryRichRule", 0, fwd.Zone, richRule).Store(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			if err := fwd.FwD1.Call(fwd1Interface+".zone.addRichRule", 0, fwd.Zone, richRule, 0).Err; err != nil {
+				return err
+			}
+		}
+		if err := zone.Call(fwd1Interface+".config.zone.queryRichRule", 0, richRule).Store(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			if err := fwd.addPermanentRule(richRule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configIPSet returns object of the ipset in firewalld permanent configuration
+func (fwd *FirewallDControl) configIPSet(name string) (dbus.BusObject, error) {
+	var ipsetPath dbus.ObjectPath
+	if err := fwd.Connection.Object(fwd1Interface, fwd1ConfigPath).Call(fwd1Interface+".config.getIPSetByName", 0, name).Store(&ipsetPath); err != nil {
+		return nil, err
+	}
+	return fwd.Connection.Object(fwd1Interface, ipsetPath), nil
+}
+
+// queryIPSetEntry checks if address is in runtime or permanent ipset
+func (fwd *FirewallDControl) queryIPSetEntry(name, entry string, permanent bool) (found bool, err error) {
+	if permanent {
+		set, err := fwd.configIPSet(name)
+		if err != nil {
+			return false, err
+		}
+		err = set.Call(fwd1Interface+".config.ipset.queryEntry", 0, entry).Store(&found)
+		return found, err
+	}
+	err = fwd.FwD1.Call(fwd1Interface+".ipset.queryEntry", 0, name, entry).Store(&found)
+	return
+}
+
+// updateIPSetEntry adds or removes address in runtime or permanent ipset
+func (fwd *FirewallDControl) updateIPSetEntry(name, entry string, add bool, permanent bool) error {
+	method := "removeEntry"
+	if add {
+		method = "addEntry"
+	}
+	log.Printf("ipset %#v: %s %s (permanent=%v)", name, method, entry, permanent)
+	if permanent {
+		set, err := fwd.configIPSet(name)
+		if err != nil {
+			return err
+		}
+		return set.Call(fwd1Interface+".config.ipset."+method, 0, entry).Err
+	}
+	return fwd.FwD1.Call(fwd1Interface+".ipset."+method, 0, name, entry).Err
+}
+
+// ipsetRules returns addresses in runtime ipsets as rich rules the same rules would have without ipsets. Entries are
+// normalized like addresses of net targets, as firewalld may list them in other form than they were added.
+func (fwd *FirewallDControl) ipsetRules() ([]BackendRule, error) {
+	var ret []BackendRule
+	for _, set := range fwd.ipsets() {
+		var entries []string
+		if err := fwd.FwD1.Call(fwd1Interface+".ipset.getEntries", 0, set.name).Store(&entries); err != nil {
+			log.Printf("Could not get entries of ipset %#v: %s", set.name, err)
+			return nil, err
+		}
+		direction := DirectionIngress
+		if set.egress {
+			direction = DirectionEgress
+		}
+		for _, entry := range entries {
+			rule := &FirewallDRule{policy: set.policy, family: set.family, sourceAddress: normalizeAddress(entry), netTarget: true}
+			ret = append(ret, BackendRule{Rule: rule.richRule(set.egress), Direction: direction})
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// IPTablesControl is backend for hosts without firewalld and nftables. Rules go to <PREFIX>-IN and <PREFIX>-OUT
+// chains of iptables and ip6tables filter table, jumped to from INPUT and OUTPUT. Addresses of ipv4_net/ipv6_net
+// targets are added to ipsets instead, one per direction, policy and family, matched by a single rule each.
+// Deny rules are inserted at the top of the chain and allow rules appended, so deny takes precedence like in firewalld.
+type IPTablesControl struct {
+	prefix string
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func iptablesCommand(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (ipt *IPTablesControl) chainName(egress bool) string {
+	if egress {
+		return strings.ToUpper(ipt.prefix) + "-OUT"
+	}
+	return strings.ToUpper(ipt.prefix) + "-IN"
+}
+
+func (ipt *IPTablesControl) setName(egress bool, policy FwDPolicy, ipv6 bool) string {
+	direction, family := "in", "4"
+	if egress {
+		direction = "out"
+	}
+	if ipv6 {
+		family = "6"
+	}
+	return fmt.Sprintf("%s-%s-%s-%s", ipt.prefix, direction, setPolicyNames[policy], family)
+}
+
+// policyArgs returns iptables target arguments for the policy
+func policyArgs(policy FwDPolicy, ipv6 bool) []string {
+	switch policy {
+	case FwDPolicyAccept:
+		return []string{"-j", "ACCEPT"}
+	case FwDPolicyDrop:
+		return []string{"-j", "DROP"}
+	case FwDPolicyRejectFalseAck:
+		return []string{"-j", "REJECT", "--reject-with", "tcp-reset"}
+	}
+	if ipv6 {
+		return []string{"-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"}
+	}
+	return []string{"-j", "REJECT", "--reject-with", "icmp-admin-prohibited"}
+}
+
+// ensureRule appends (or inserts at the top) rule to chain unless it is there already
+func ensureRule(ipv6 bool, chain string, insert bool, args ...string) error {
+	if _, err := runCommand(iptablesCommand(ipv6), append([]string{"-C", chain}, args...)...); err == nil {
+		return nil
+	}
+	op := []string{"-A", chain}
+	if insert {
+		op = []string{"-I", chain, "1"}
+	}
+	_, err := runCommand(iptablesCommand(ipv6), append(op, args...)...)
+	return err
+}
+
+// NewIPTablesControl creates chains, ipsets and rules matching the ipsets, if they don't exist yet
+func NewIPTablesControl(prefix string) (*IPTablesControl, error) {
+	ipt := &IPTablesControl{prefix: prefix}
+	for _, ipv6 := range []bool{false, true} {
+		family := "inet"
+		if ipv6 {
+			family = "inet6"
+		}
+		for _, egress := range []bool{false, true} {
+			chain := ipt.chainName(egress)
+			if _, err := runCommand(iptablesCommand(ipv6), "-S", chain); err != nil {
+				if _, err := runCommand(iptablesCommand(ipv6), "-N", chain); err != nil {
+					return nil, err
+				}
+			}
+			hook, match := "INPUT", "src"
+			if egress {
+				hook, match = "OUTPUT", "dst"
+			}
+			if err := ensureRule(ipv6, hook, true, "-j", chain); err != nil {
+				return nil, err
+			}
+			for _, policy := range setPolicies {
+				set := ipt.setName(egress, policy, ipv6)
+				if _, err := runCommand("ipset", "create", set, "hash:net", "family", family, "-exist"); err != nil {
+					return nil, err
+				}
+				args := []string{"-m", "set", "--match-set", set, match}
+				if policy == FwDPolicyRejectFalseAck {
+					args = append([]string{"-p", "tcp"}, args...)
+				}
+				if err := ensureRule(ipv6, chain, false, append(args, policyArgs(policy, ipv6)...)...); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	log.Printf("Using iptables chains %s, %s", ipt.chainName(false), ipt.chainName(true))
+	return ipt, nil
+}
+
+// normalizeAddress returns address in canonical form the way ipset lists it: network address instead of host bits,
+// compressed IPv6 and no prefix length for single hosts
+func normalizeAddress(address string) string {
+	if ip, network, err := net.ParseCIDR(address); err == nil {
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return ip.String()
+		}
+		return network.String()
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+// iptablesPorts returns port range in iptables --sport/--dport syntax
+func iptablesPorts(ports openc2.PortRange) string {
+	if ports.First == ports.Last {
+		return fmt.Sprint(ports.First)
+	}
+	return fmt.Sprintf("%d:%d", ports.First, ports.Last)
+}
+
+// ruleArgs returns iptables arguments matching connection rule, without the target
+func ruleArgs(rule *FirewallDRule) []string {
+	var args []string
+	if rule.sourceAddress != "" {
+		args = append(args, "-s", rule.sourceAddress)
+	}
+	if rule.destinationAddress != "" {
+		args = append(args, "-d", rule.destinationAddress)
+	}
+	protocol := rule.familyProtocol()
+	if protocol == "" && rule.policy == FwDPolicyRejectFalseAck {
+		protocol = "tcp"
+	}
+	if protocol != "" {
+		args = append(args, "-p", protocol)
+	}
+	if len(rule.sourcePort) != 0 {
+		args = append(args, "--sport", iptablesPorts(rule.sourcePort[0]))
+	}
+	if len(rule.destinationPort) != 0 {
+		args = append(args, "--dport", iptablesPorts(rule.destinationPort[0]))
+	}
+	return args
+}
+
+// RuleText returns ipset member line for net targets and iptables rule arguments for the rest
+func (ipt *IPTablesControl) RuleText(rule *FirewallDRule, egress bool) string {
+	ipv6 := rule.family == "ipv6"
+	if rule.netTarget {
+		return fmt.Sprintf("add %s %s", ipt.setName(egress, rule.policy, ipv6), normalizeAddress(rule.sourceAddress))
+	}
+	return strings.Join(append(ruleArgs(rule), policyArgs(rule.policy, ipv6)...), " ")
+}
+
+// families returns ipv6 flags for families the rule applies to
+func families(rule *FirewallDRule) []bool {
+	switch rule.family {
+	case "ipv4":
+		return []bool{false}
+	case "ipv6":
+		return []bool{true}
+	}
+	return []bool{false, true}
+}
+
+func (ipt *IPTablesControl) addPart(rule *FirewallDRule, egress bool) error {
+	if rule.netTarget {
+		set := ipt.setName(egress, rule.policy, rule.family == "ipv6")
+		_, err := runCommand("ipset", "add", set, rule.sourceAddress, "-exist")
+		return err
+	}
+	for _, single := range rule.split() {
+		for _, ipv6 := range families(rule) {
+			args := append(ruleArgs(single), "-m", "comment", "--comment", ipt.RuleText(single, egress))
+			args = append(args, policyArgs(rule.policy, ipv6)...)
+			if err := ensureRule(ipv6, ipt.chainName(egress), rule.policy != FwDPolicyAccept, args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ipt *IPTablesControl) removePart(rule *FirewallDRule, egress bool) error {
+	if rule.netTarget {
+		set := ipt.setName(egress, rule.policy, rule.family == "ipv6")
+		_, err := runCommand("ipset", "del", set, rule.sourceAddress, "-exist")
+		return err
+	}
+	for _, single := range rule.split() {
+		for _, ipv6 := range families(rule) {
+			args := append([]string{"-D", ipt.chainName(egress)}, ruleArgs(single)...)
+			args = append(args, "-m", "comment", "--comment", ipt.RuleText(single, egress))
+			args = append(args, policyArgs(rule.policy, ipv6)...)
+			if _, err := runCommand(iptablesCommand(ipv6), args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddRule adds ingress and egress parts of the rule, timeout is not supported
+func (ipt *IPTablesControl) AddRule(rule *FirewallDRule, timeout int) error {
+	log.Printf("Adding rule: %s (direction=%#v)", rule, rule.direction)
+	if rule.ingress() {
+		if err := ipt.addPart(rule, false); err != nil {
+			return err
+		}
+	}
+	if rule.egress() {
+		if err := ipt.addPart(rule, true); err != nil {
+			if rule.ingress() {
+				if err := ipt.removePart(rule, false); err != nil {
+					log.Printf("Could not roll back ingress part of rule %s: %s", rule, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveRule removes all parts of the rule, trying to remove the rest if one fails
+func (ipt *IPTablesControl) RemoveRule(rule *FirewallDRule) (err error) {
+	log.Printf("Removing rule: %s (direction=%#v)", rule, rule.direction)
+	if rule.ingress() {
+		err = ipt.removePart(rule, false)
+	}
+	if rule.egress() {
+		if e := ipt.removePart(rule, true); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// commentOf returns comment of rule printed by iptables -S
+func commentOf(line string) string {
+	const marker = "--comment "
+	i := strings.Index(line, marker)
+	if i < 0 {
+		return ""
+	}
+	comment := line[i+len(marker):]
+	if strings.HasPrefix(comment, "\"") {
+		if end := strings.Index(comment[1:], "\""); end >= 0 {
+			return comment[1 : end+1]
+		}
+	}
+	return strings.Fields(comment)[0]
+}
+
+// ListRules returns ipset members and iptables rules of the chains, except the rules matching ipsets
+func (ipt *IPTablesControl) ListRules() ([]BackendRule, error) {
+	var ret []BackendRule
+	seen := make(map[BackendRule]bool)
+	for _, egress := range []bool{false, true} {
+		direction := DirectionIngress
+		if egress {
+			direction = DirectionEgress
+		}
+		for _, ipv6 := range []bool{false, true} {
+			for _, policy := range setPolicies {
+				out, err := runCommand("ipset", "save", ipt.setName(egress, policy, ipv6))
+				if err != nil {
+					return nil, err
+				}
+				scanner := bufio.NewScanner(strings.NewReader(out))
+				for scanner.Scan() {
+					if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "add ") {
+						ret = append(ret, BackendRule{Rule: line, Direction: direction})
+					}
+				}
+			}
+			out, err := runCommand(iptablesCommand(ipv6), "-S", ipt.chainName(egress))
+			if err != nil {
+				return nil, err
+			}
+			scanner := bufio.NewScanner(strings.NewReader(out))
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if !strings.HasPrefix(line, "-A ") || strings.Contains(line, "--match-set") {
+					continue
+				}
+				text := commentOf(line)
+				if text == "" {
+					text = line
+				}
+				// rules without family are installed in both iptables and ip6tables
+				if rule := (BackendRule{Rule: text, Direction: direction}); !seen[rule] {
+					seen[rule] = true
+					ret = append(ret, rule)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (ipt *IPTablesControl) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Egress: true, SourceAndDestinationPort: true}
+}
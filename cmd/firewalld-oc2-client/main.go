@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -20,22 +22,137 @@ const userAgent = "OpenC2-FirewallD-Client/" + clientVersion
 var UnknownActionError = errors.New("Unknown action")
 var UnknownTargetError = errors.New("Unknown target type")
 var InvalidRuleNumber = errors.New("Invalid rule number")
+var RuleNumberInUse = errors.New("Rule number currently in use")
+var EgressNotSupported = errors.New("Egress filtering not available")
+var PersistentNotSupported = errors.New("Persistent rules not available")
+var ICMPTypeNotSupported = errors.New("ICMP type matching not available")
+var FileHashMismatch = errors.New("File hash mismatch")
+var FileHashMissing = errors.New("File hashes missing")
+var InvalidRuleFile = errors.New("Invalid rule file")
+var RuleFileNotAllowed = errors.New("Rule file location not allowed")
+var BatchRolledBack = errors.New("Batch rolled back, another command in it failed")
 
-func main() {
-	fwdctrl, err := NewFirewallDControl()
+// InvalidRuleError is a combination of target and arguments which can't be made into a rule
+type InvalidRuleError struct {
+	Reason string
+}
+
+func (e *InvalidRuleError) Error() string {
+	return "Invalid rule: " + e.Reason
+}
+
+func errorResponse(err error) *openc2.OpenC2Response {
+	switch e := err.(type) {
+	case *InvalidRuleError:
+		return &openc2.OpenC2Response{Status: openc2.StatusBadRequest, StatusText: err.Error()}
+	case *openc2.ValidationError:
+		resp := e.Response()
+		return &resp
+	case *openc2.UnknownProfileError:
+		return &openc2.OpenC2Response{Status: openc2.StatusNotImplemented, StatusText: err.Error()}
+	}
+	switch err {
+	case UnknownActionError, UnknownTargetError, EgressNotSupported, PersistentNotSupported, ICMPTypeNotSupported:
+		return &openc2.OpenC2Response{Status: openc2.StatusNotImplemented, StatusText: err.Error()}
+	case openc2.InvalidArgsError, RuleNumberInUse, FileHashMismatch, FileHashMissing, InvalidRuleFile, RuleFileNotAllowed:
+		return &openc2.OpenC2Response{Status: openc2.StatusBadRequest, StatusText: err.Error()}
+	case InvalidRuleNumber:
+		return &openc2.OpenC2Response{Status: openc2.StatusNotFound, StatusText: err.Error()}
+	}
+	return &openc2.OpenC2Response{Status: openc2.StatusInternalError, StatusText: err.Error()}
+}
+
+func postResponse(serverURL, assetID, commandID string, oc2resp *openc2.OpenC2Response) error {
+	header := make(http.Header)
+	if assetID != "" {
+		header.Set(openc2.OpenC2AssetIDHeader, assetID)
+	}
+	if commandID != "" {
+		header.Set(openc2.OpenC2CorrelationIdHeader, commandID)
+	}
+	return postResponseHeader(serverURL, header, oc2resp)
+}
+
+// postResponseHeader posts response to the server with header identifying the asset and command
+func postResponseHeader(serverURL string, header http.Header, oc2resp *openc2.OpenC2Response) error {
+	data, err := json.Marshal(oc2resp)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", serverURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", openc2.OpenC2ResponseType)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatal("Could not get FirewallD control: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status from server: %s", resp.Status)
 	}
+	return nil
+}
 
+// postAssetResponse posts response not related to any command to the server, with key=value added to the URL query
+func postAssetResponse(server string, header http.Header, key, value string, oc2resp *openc2.OpenC2Response) error {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	query := serverURL.Query()
+	query.Set(key, value)
+	serverURL.RawQuery = query.Encode()
+	return postResponseHeader(serverURL.String(), header, oc2resp)
+}
+
+// registerFeatures advertises features supported by the client to the server, header carries asset ID and specifiers
+func registerFeatures(server string, header http.Header, features map[string]interface{}) error {
+	return postAssetResponse(server, header, "register", "features", &openc2.OpenC2Response{Status: openc2.StatusOK, Results: features})
+}
+
+// reportDrift reports managed rules reinstalled after being changed outside of OpenC2 to the server
+func reportDrift(server string, header http.Header, report *openc2.OpenC2Response) error {
+	return postAssetResponse(server, header, "report", "drift", report)
+}
+
+func main() {
 	server := flag.String("server", "https://localhost:1512/oc2", "OpenC2 server URL")
-	zone := flag.String("zone", fwdctrl.Zone, "Zone to manipulate")
+	backendName := flag.String("backend", "firewalld", "Firewall backend: firewalld, nftables, iptables or simulation")
+	zone := flag.String("zone", "", "Zone to manipulate (default: firewalld default zone)")
+	ipsetPrefix := flag.String("ipset-prefix", "", "Prefix of firewalld ipsets for ipv4_net/ipv6_net addresses, ex: oc2 (empty: one rich rule per address)")
+	nftTable := flag.String("nft-table", "oc2", "nftables inet table managed by nftables backend")
+	iptPrefix := flag.String("ipt-prefix", "oc2", "Prefix of chains and ipsets managed by iptables backend")
+	egressPolicy := flag.String("egress-policy", "", "Firewalld policy for egress rules, ex: oc2-egress (empty: no egress filtering)")
 	assetID := flag.String("id", "", "Asset ID to use")
+	namedGroups := flag.String("group", "", "Comma-separated list of named groups the asset belongs to")
+	assetTuple := flag.String("tuple", "", "Comma-separated asset tuple identifying the asset")
 	waitIntervalFlag := flag.Float64("interval", 10, "wait interval in seconds")
+	pollMode := flag.String("mode", PollModeAuto, "Command delivery mode: auto, sse, longpoll or poll")
+	longPollWait := flag.Duration("wait", 30*time.Second, "Time for server to hold long-polling request")
+	batchSize := flag.Int("batch", 100, "Maximum number of commands to receive in one batch (0: one command per request)")
+	mqttBroker := flag.String("mqtt", "", "MQTT broker URL to subscribe to commands instead of polling, ex: tcp://localhost:1883")
+	mqttPrefix := flag.String("mqtt-prefix", openc2.MQTTCommandPrefix, "MQTT topic prefix for commands")
 	certFile := flag.String("cert", "client.crt", "Client X509 certificate")
 	keyFile := flag.String("key", "client.key", "Private key for x509 certificate")
+	rateLimit := flag.Float64("rate-limit", 0, "Maximum number of commands per minute advertised to the server (0: not advertised)")
+	stateFile := flag.String("state", "firewalld-oc2-client.json", "File to keep rule numbers and scheduled commands in")
+	ruleDir := flag.String("rule-dir", "", "Directory local rule files of update commands are read from (empty: only http(s) URLs)")
+	reconcileInterval := flag.Duration("reconcile", time.Minute, "Interval of reinstalling managed rules missing from the firewall (0: only on firewalld signals)")
 	// serverCa := flag.String("ca", "ca.crt", "Server CA")
 
 	flag.Parse()
+	switch *pollMode {
+	case PollModeAuto, PollModeSSE, PollModeLongPoll, PollModePoll:
+	default:
+		log.Fatalf("Unknown mode: %#v", *pollMode)
+	}
+	if *mqttBroker != "" && *assetID == "" {
+		log.Fatal("Asset ID (-id) is required with MQTT")
+	}
 
 	if strings.HasPrefix(*server, "https") {
 		http.DefaultClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
@@ -54,50 +171,77 @@ func main() {
 		}
 		http.DefaultClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
 	}
-	if *zone != fwdctrl.Zone {
-		log.Printf("FW zone set to %s", *zone)
-		fwdctrl.Zone = *zone
-	}
-
-	for {
-		waitIntervalDelay := time.Nanosecond * time.Duration(int(*waitIntervalFlag*10e8))
-		req, err := http.NewRequest("GET", *server, nil)
+	var backend FirewallBackend
+	switch *backendName {
+	case "firewalld":
+		fwdctrl, err := NewFirewallDControl()
 		if err != nil {
-			log.Fatal("Cannot create request: ", err)
+			log.Fatal("Could not get FirewallD control: ", err)
 		}
-		if *assetID != "" {
-			req.Header.Set(openc2.OpenC2AssetIDHeader, *assetID)
+		if *zone != "" && *zone != fwdctrl.Zone {
+			log.Printf("FW zone set to %s", *zone)
+			fwdctrl.Zone = *zone
 		}
-		req.Header.Set("Accept", openc2.OpenC2CommandType)
-		req.Header.Set("User-Agent", userAgent)
-		log.Printf("Sending request for data (asset-id=%#v)", *assetID)
-		if resp, err := http.DefaultClient.Do(req); err != nil {
-			log.Printf("Error getting data from OpenC2 server: %s", err)
-		} else {
-			log.Printf("Response from server: %#v", resp)
-			if responseAssetID := resp.Header.Get("X-OpenC2-Asset-Id"); responseAssetID != "" {
-				log.Printf("Asset ID set to %#v", responseAssetID)
-				*assetID = responseAssetID
+		if *egressPolicy != "" {
+			fwdctrl.EgressPolicy = *egressPolicy
+			if err := fwdctrl.EnsureEgressPolicy(); err != nil {
+				log.Fatalf("Cannot use egress policy %#v: %s", *egressPolicy, err)
 			}
-			if resp.ContentLength > 0 {
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Print("Cannot read body: ", err)
-				} else {
-					var oc2cmd openc2.OpenC2Command
-					if err := json.Unmarshal(body, &oc2cmd); err != nil {
-						log.Printf("Failed to parse response: %s: %#v", err, string(body))
-					} else {
-						fwdctrl.OpenC2Act(oc2cmd)
-						waitIntervalDelay = 0
-					}
-				}
+		}
+		if *ipsetPrefix != "" {
+			fwdctrl.IPSetPrefix = *ipsetPrefix
+			if err := fwdctrl.EnsureIPSets(); err != nil {
+				log.Fatalf("Cannot use ipsets with prefix %#v: %s", *ipsetPrefix, err)
 			}
 		}
-		if waitIntervalDelay > 0 {
-			log.Printf("Sleeping %s before next run..", waitIntervalDelay)
-			time.Sleep(waitIntervalDelay)
+		backend = fwdctrl
+	case "nftables":
+		nftctrl, err := NewNFTablesControl(*nftTable)
+		if err != nil {
+			log.Fatal("Could not get nftables control: ", err)
+		}
+		backend = nftctrl
+	case "iptables":
+		iptctrl, err := NewIPTablesControl(*iptPrefix)
+		if err != nil {
+			log.Fatal("Could not get iptables control: ", err)
+		}
+		backend = iptctrl
+	case "simulation":
+		log.Print("WARNING: simulation backend, rules are not installed")
+		backend = NewSimulatedFirewall()
+	default:
+		log.Fatalf("Unknown backend: %#v", *backendName)
+	}
+	actuator := NewOpenC2Actuator(backend)
+	actuator.RateLimit = *rateLimit
+	actuator.RuleDir = *ruleDir
+	if *stateFile != "" {
+		if err := actuator.LoadState(*stateFile); err != nil {
+			log.Fatalf("Cannot load state from %#v: %s", *stateFile, err)
+		}
+	}
+	go actuator.RunScheduler(time.Second)
 
+	poller := &commandPoller{
+		Server:      *server,
+		AssetID:     *assetID,
+		NamedGroups: *namedGroups,
+		AssetTuple:  *assetTuple,
+		Mode:        *pollMode,
+		Interval:    time.Nanosecond * time.Duration(int(*waitIntervalFlag*10e8)),
+		Wait:        *longPollWait,
+		BatchSize:   *batchSize,
+		Actuator:    actuator,
+	}
+	go actuator.RunReconciler(*reconcileInterval, poller.ReportDrift)
+	if *mqttBroker != "" {
+		var tlsConfig *tls.Config
+		if http.DefaultClient.Transport != nil {
+			tlsConfig = http.DefaultClient.Transport.(*http.Transport).TLSClientConfig
 		}
+		poller.RunMQTT(*mqttBroker, *mqttPrefix, tlsConfig)
+	} else {
+		poller.Run()
 	}
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/korc/openc2-firewalld"
+)
+
+func splitList(list string) (ret []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// accepts checks actuator specifiers of a command received from a shared MQTT topic
+func (p *commandPoller) accepts(cmd *openc2.OpenC2Command) bool {
+	if len(cmd.Actuator.Profiles()) == 0 {
+		return true
+	}
+	specifiers := cmd.Actuator.SLPF()
+	if specifiers == nil {
+		return false
+	}
+	if id := specifiers.AssetID; id != "" && id != p.AssetID {
+		return false
+	}
+	if group := specifiers.NamedGroup; group != "" {
+		found := false
+		for _, g := range splitList(p.NamedGroups) {
+			if g == group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if tuple := specifiers.AssetTuple; tuple != nil {
+		assetTuple := splitList(p.AssetTuple)
+		if len(tuple) != len(assetTuple) {
+			return false
+		}
+		for i := range tuple {
+			if tuple[i] != assetTuple[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *commandPoller) handleMessage(c mqtt.Client, msg mqtt.Message) {
+	var oc2cmd openc2.OpenC2Command
+	if err := json.Unmarshal(msg.Payload(), &oc2cmd); err != nil {
+		log.Printf("Failed to parse command from %#v: %s: %#v", msg.Topic(), err, string(msg.Payload()))
+		return
+	}
+	if !p.accepts(&oc2cmd) {
+		log.Printf("Command %#v from %#v not addressed to this asset, skipping", oc2cmd.ID, msg.Topic())
+		return
+	}
+	p.execute(oc2cmd)
+}
+
+// connectMQTT connects to MQTT broker and subscribes to command topics of the asset on every connect
+func (p *commandPoller) connectMQTT(broker, prefix string, tlsConfig *tls.Config) (mqtt.Client, error) {
+	var profiles []string
+	if list, ok := p.Actuator.Features()["profiles"].([]string); ok {
+		profiles = list
+	}
+	topics := make(map[string]byte)
+	for _, topic := range openc2.MQTTAssetTopics(prefix, p.AssetID, profiles, splitList(p.NamedGroups)) {
+		topics[topic] = 1
+	}
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID("oc2-" + p.AssetID).
+		SetCleanSession(false).SetAutoReconnect(true).SetOrderMatters(true)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Printf("Connected to MQTT broker %#v, subscribing to %#v", broker, topics)
+		if token := c.SubscribeMultiple(topics, p.handleMessage); token.Wait() && token.Error() != nil {
+			log.Printf("Cannot subscribe to command topics: %s", token.Error())
+		}
+		// the server learns about the asset only from registration, as it never polls
+		if err := registerFeatures(p.Server, p.assetHeader(), p.Actuator.Features()); err != nil {
+			log.Printf("Could not register features: %s", err)
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Printf("Connection to MQTT broker %#v lost: %s", broker, err)
+	})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+// RunMQTT subscribes to command topics of the asset on MQTT broker instead of polling the server.
+// The asset and its features are registered with the server and responses are sent to it over HTTP. Session is kept by the broker, so commands published
+// while the client was offline are received after reconnecting.
+func (p *commandPoller) RunMQTT(broker, prefix string, tlsConfig *tls.Config) {
+	if _, err := p.connectMQTT(broker, prefix, tlsConfig); err != nil {
+		log.Fatalf("Cannot connect to MQTT broker %#v: %s", broker, err)
+	}
+	select {}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/korc/openc2-firewalld"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker starts in-process MQTT broker on a random local port, returns its URL
+func startBroker(t *testing.T) string {
+	server := broker.New(&broker.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+func TestMQTTCommands(t *testing.T) {
+	brokerURL := startBroker(t)
+	responses := make(chan string, 10)
+	registrations := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var oc2resp openc2.OpenC2Response
+		json.NewDecoder(r.Body).Decode(&oc2resp)
+		if r.URL.Query().Get("register") == "features" {
+			if oc2resp.Results["profiles"] != nil {
+				registrations <- r.Header.Get(openc2.OpenC2AssetIDHeader)
+			}
+		} else {
+			responses <- r.Header.Get(openc2.OpenC2CorrelationIdHeader)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	sim := NewSimulatedFirewall()
+	p := &commandPoller{Server: ts.URL, AssetID: "fw1", Actuator: NewOpenC2Actuator(sim)}
+	client, err := p.connectMQTT(brokerURL, openc2.MQTTCommandPrefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID("test-producer"))
+	if token := producer.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer producer.Disconnect(0)
+	publish := func(command string) {
+		var oc2cmd openc2.OpenC2Command
+		if err := json.Unmarshal([]byte(command), &oc2cmd); err != nil {
+			t.Fatal(err)
+		}
+		token := producer.Publish(openc2.MQTTCommandTopic(openc2.MQTTCommandPrefix, &oc2cmd), 1, false, command)
+		if token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	waitRegistration := func() {
+		select {
+		case assetID := <-registrations:
+			if assetID != "fw1" {
+				t.Errorf("Registered as %#v instead of fw1", assetID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Asset not registered after connecting")
+		}
+	}
+	waitResponse := func(id string, retry func()) {
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-responses:
+				if got == id {
+					return
+				}
+			case <-time.After(200 * time.Millisecond):
+				if retry != nil {
+					retry()
+				}
+			case <-deadline:
+				t.Fatalf("No response to %s", id)
+			}
+		}
+	}
+
+	// the server learns about the asset only from registration, on every connect
+	waitRegistration()
+
+	// subscription is made after connecting, command is published again until it gets there
+	cmd1 := `{"id": "cmd1", "action": "deny", "target": {"ipv4_net": "10.0.0.0/8"}, "actuator": {"slpf": {"asset_id": "fw1"}}}`
+	publish(cmd1)
+	waitResponse("cmd1", func() { publish(cmd1) })
+	publish(`{"id": "other", "action": "deny", "target": {"ipv4_net": "10.0.0.0/8"}, "actuator": {"slpf": {"asset_id": "fw2"}}}`)
+
+	// command published while the client is offline is kept in its session
+	client.Disconnect(250)
+	publish(`{"id": "cmd2", "action": "deny", "target": {"ipv4_net": "192.168.0.0/16"}, "actuator": {"slpf": {"named_group": "x"}}}`)
+	publish(`{"id": "cmd3", "action": "deny", "target": {"ipv4_net": "172.16.0.0/12"}}`)
+	client, err = p.connectMQTT(brokerURL, openc2.MQTTCommandPrefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+	waitRegistration()
+	waitResponse("cmd3", nil)
+	if rules, _ := sim.ListRules(); len(rules) != 4 {
+		t.Errorf("Expected 4 rules, got %#v", rules)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/korc/openc2-firewalld"
+	"golang.org/x/sys/unix"
+)
+
+// NFTablesControl is backend installing rules into its own inet table of nftables over netlink.
+// Ingress rules go to the input chain and egress rules to the output chain, each rule tagged with its text
+// in rule user data, so it can be found again for listing and removal.
+type NFTablesControl struct {
+	conn   *nftables.Conn
+	table  *nftables.Table
+	input  *nftables.Chain
+	output *nftables.Chain
+}
+
+// NewNFTablesControl creates table and its input/output chains if they don't exist yet
+func NewNFTablesControl(tableName string) (*NFTablesControl, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	nft := &NFTablesControl{conn: conn}
+	nft.table = conn.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: tableName})
+	accept := nftables.ChainPolicyAccept
+	nft.input = conn.AddChain(&nftables.Chain{Name: "input", Table: nft.table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter, Policy: &accept})
+	nft.output = conn.AddChain(&nftables.Chain{Name: "output", Table: nft.table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityFilter, Policy: &accept})
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	log.Printf("Using nftables table inet %s", tableName)
+	return nft, nil
+}
+
+func (nft *NFTablesControl) chain(egress bool) *nftables.Chain {
+	if egress {
+		return nft.output
+	}
+	return nft.input
+}
+
+// ruleAddresses returns source and destination address of the rule part, address of ipv4_net/ipv6_net target
+// being destination for egress
+func ruleAddresses(rule *FirewallDRule, egress bool) (source, destination string) {
+	if rule.netTarget && egress {
+		return "", rule.sourceAddress
+	}
+	return rule.sourceAddress, rule.destinationAddress
+}
+
+func nftFamily(rule *FirewallDRule) string {
+	if rule.family == "ipv6" {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// RuleText returns rule in nft syntax
+func (nft *NFTablesControl) RuleText(rule *FirewallDRule, egress bool) string {
+	var parts []string
+	source, destination := ruleAddresses(rule, egress)
+	if source != "" {
+		parts = append(parts, nftFamily(rule), "saddr", source)
+	}
+	if destination != "" {
+		parts = append(parts, nftFamily(rule), "daddr", destination)
+	}
+	if source == "" && destination == "" && rule.family != "" {
+		parts = append(parts, "meta nfproto", map[string]string{"ipv4": "ipv4", "ipv6": "ipv6"}[rule.family])
+	}
+	protocol := rule.familyProtocol()
+	if protocol == "" && rule.policy == FwDPolicyRejectFalseAck {
+		protocol = "tcp"
+	}
+	if protocol != "" && len(rule.sourcePort) == 0 && len(rule.destinationPort) == 0 {
+		parts = append(parts, "meta l4proto", protocol)
+	}
+	if len(rule.sourcePort) != 0 {
+		parts = append(parts, protocol, "sport", rule.sourcePort.String())
+	}
+	if len(rule.destinationPort) != 0 {
+		parts = append(parts, protocol, "dport", rule.destinationPort.String())
+	}
+	switch rule.policy {
+	case FwDPolicyAccept:
+		parts = append(parts, "accept")
+	case FwDPolicyDrop:
+		parts = append(parts, "drop")
+	case FwDPolicyRejectFalseAck:
+		parts = append(parts, "reject with tcp reset")
+	default:
+		parts = append(parts, "reject with icmpx admin-prohibited")
+	}
+	return strings.Join(parts, " ")
+}
+
+// addressMatch returns expressions matching source or destination address or network
+func addressMatch(address string, ipv6, destination bool) ([]expr.Any, error) {
+	var offset, length uint32 = 12, 4
+	if ipv6 {
+		offset, length = 8, 16
+	}
+	if destination {
+		offset += length
+	}
+	var ip net.IP
+	var mask net.IPMask
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		ip, mask = network.IP, network.Mask
+	} else if ip = net.ParseIP(address); ip == nil {
+		return nil, fmt.Errorf("invalid address: %#v", address)
+	}
+	if ipv6 {
+		ip = ip.To16()
+	} else if ip = ip.To4(); ip == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %#v", address)
+	}
+	exprs := []expr.Any{&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length}}
+	if mask != nil && len(mask) == len(ip) && !bytes.Equal(mask, net.CIDRMask(len(ip)*8, len(ip)*8)) {
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: mask, Xor: make([]byte, length)})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip}), nil
+}
+
+func portMatch(ports openc2.PortRange, destination bool) []expr.Any {
+	var offset uint32
+	if destination {
+		offset = 2
+	}
+	first, last := []byte{byte(ports.First >> 8), byte(ports.First)}, []byte{byte(ports.Last >> 8), byte(ports.Last)}
+	match := expr.Any(&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: first})
+	if ports.First != ports.Last {
+		match = &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: first, ToData: last}
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+		match,
+	}
+}
+
+var protocolNumbers = map[string]byte{
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"sctp":      unix.IPPROTO_SCTP,
+	"icmp":      unix.IPPROTO_ICMP,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+}
+
+// ruleExprs translates ingress or egress part of the rule to nftables expressions
+func ruleExprs(rule *FirewallDRule, egress bool) ([]expr.Any, error) {
+	ipv6 := rule.family == "ipv6"
+	nfproto := byte(unix.NFPROTO_IPV4)
+	if ipv6 {
+		nfproto = unix.NFPROTO_IPV6
+	}
+	var exprs []expr.Any
+	source, destination := ruleAddresses(rule, egress)
+	if rule.family != "" || source != "" || destination != "" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}})
+	}
+	for _, address := range []struct {
+		address     string
+		destination bool
+	}{{source, false}, {destination, true}} {
+		if address.address == "" {
+			continue
+		}
+		match, err := addressMatch(address.address, ipv6, address.destination)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+	protocol := rule.familyProtocol()
+	if protocol == "" && rule.policy == FwDPolicyRejectFalseAck {
+		// tcp reset can be sent only in response to tcp
+		protocol = "tcp"
+	}
+	if protocol != "" {
+		number, ok := protocolNumbers[protocol]
+		if !ok {
+			return nil, fmt.Errorf("unsupported protocol: %#v", protocol)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{number}})
+	}
+	if len(rule.sourcePort) != 0 {
+		exprs = append(exprs, portMatch(rule.sourcePort[0], false)...)
+	}
+	if len(rule.destinationPort) != 0 {
+		exprs = append(exprs, portMatch(rule.destinationPort[0], true)...)
+	}
+	switch rule.policy {
+	case FwDPolicyAccept:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case FwDPolicyDrop:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case FwDPolicyRejectFalseAck:
+		exprs = append(exprs, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST})
+	default:
+		exprs = append(exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED})
+	}
+	return exprs, nil
+}
+
+// findRules returns rules of the chain with rule text in user data
+func (nft *NFTablesControl) findRules(egress bool, text string) ([]*nftables.Rule, error) {
+	rules, err := nft.conn.GetRules(nft.table, nft.chain(egress))
+	if err != nil {
+		return nil, err
+	}
+	var found []*nftables.Rule
+	for _, rule := range rules {
+		if string(rule.UserData) == text {
+			found = append(found, rule)
+		}
+	}
+	return found, nil
+}
+
+// AddRule adds ingress and egress parts of the rule in one netlink transaction, timeout is not supported
+func (nft *NFTablesControl) AddRule(rule *FirewallDRule, timeout int) error {
+	log.Printf("Adding rule: %s (direction=%#v)", rule, rule.direction)
+	for _, single := range rule.split() {
+		for _, egress := range []bool{false, true} {
+			if egress && !rule.egress() || !egress && !rule.ingress() {
+				continue
+			}
+			text := nft.RuleText(single, egress)
+			if existing, err := nft.findRules(egress, text); err != nil {
+				return err
+			} else if len(existing) > 0 {
+				log.Printf("Rule already present: %s", text)
+				continue
+			}
+			exprs, err := ruleExprs(single, egress)
+			if err != nil {
+				return err
+			}
+			nft.conn.AddRule(&nftables.Rule{Table: nft.table, Chain: nft.chain(egress), Exprs: exprs, UserData: []byte(text)})
+		}
+	}
+	return nft.conn.Flush()
+}
+
+func (nft *NFTablesControl) RemoveRule(rule *FirewallDRule) error {
+	log.Printf("Removing rule: %s (direction=%#v)", rule, rule.direction)
+	for _, single := range rule.split() {
+		for _, egress := range []bool{false, true} {
+			if egress && !rule.egress() || !egress && !rule.ingress() {
+				continue
+			}
+			found, err := nft.findRules(egress, nft.RuleText(single, egress))
+			if err != nil {
+				return err
+			}
+			for _, r := range found {
+				if err := nft.conn.DelRule(r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nft.conn.Flush()
+}
+
+// ListRules returns rules of the input and output chains, by their text or handle for rules added by others
+func (nft *NFTablesControl) ListRules() ([]BackendRule, error) {
+	var ret []BackendRule
+	for _, egress := range []bool{false, true} {
+		direction := DirectionIngress
+		if egress {
+			direction = DirectionEgress
+		}
+		rules, err := nft.conn.GetRules(nft.table, nft.chain(egress))
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			text := string(rule.UserData)
+			if text == "" {
+				text = fmt.Sprintf("handle %d", rule.Handle)
+			}
+			ret = append(ret, BackendRule{Rule: text, Direction: direction})
+		}
+	}
+	return ret, nil
+}
+
+func (nft *NFTablesControl) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Egress: true, SourceAndDestinationPort: true}
+}
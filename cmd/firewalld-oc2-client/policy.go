@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus"
+)
+
+// Egress rules are rich rules in a firewalld (>= 0.9) policy object for traffic from the host to any zone.
+// Policies can't be changed rule by rule over D-Bus, so the whole rich_rules setting is replaced instead.
+
+func richRulesFromSettings(settings map[string]dbus.Variant) []string {
+	if v, ok := settings["rich_rules"]; ok {
+		if rules, ok := v.Value().([]string); ok {
+			return rules
+		}
+	}
+	return nil
+}
+
+func (fwd *FirewallDControl) configPolicy() (dbus.BusObject, error) {
+	var policyPath dbus.ObjectPath
+	if err := fwd.Connection.Object(fwd1Interface, fwd1ConfigPath).Call(fwd1Interface+".config.getPolicyByName", 0, fwd.EgressPolicy).Store(&policyPath); err != nil {
+		return nil, err
+	}
+	return fwd.Connection.Object(fwd1Interface, policyPath), nil
+}
+
+func (fwd *FirewallDControl) getPolicySettings(permanent bool) (settings map[string]dbus.Variant, err error) {
+	if permanent {
+		policy, err := fwd.configPolicy()
+		if err != nil {
+			return nil, err
+		}
+		err = policy.Call(fwd1Interface+".config.policy.getSettings", 0).Store(&settings)
+		return settings, err
+	}
+	err = fwd.FwD1.Call(fwd1Interface+".policy.getPolicySettings", 0, fwd.EgressPolicy).Store(&settings)
+	return
+}
+
+func (fwd *FirewallDControl) setPolicySettings(settings map[string]dbus.Variant, permanent bool) error {
+	if permanent {
+		policy, err := fwd.configPolicy()
+		if err != nil {
+			return err
+		}
+		return policy.Call(fwd1Interface+".config.policy.update", 0, settings).Err
+	}
+	return fwd.FwD1.Call(fwd1Interface+".policy.setPolicySettings", 0, fwd.EgressPolicy, settings).Err
+}
+
+// GetPolicyRichRules returns rich rules currently active in the egress policy
+func (fwd *FirewallDControl) GetPolicyRichRules() ([]string, error) {
+	settings, err := fwd.getPolicySettings(false)
+	if err != nil {
+		log.Printf("Could not get settings of policy %#v: %s", fwd.EgressPolicy, err)
+		return nil, err
+	}
+	return richRulesFromSettings(settings), nil
+}
+
+// updatePolicyRichRule adds or removes rich rule in runtime or permanent egress policy
+func (fwd *FirewallDControl) updatePolicyRichRule(richRule string, add bool, permanent bool) error {
+	settings, err := fwd.getPolicySettings(permanent)
+	if err != nil {
+		return err
+	}
+	rules := make([]string, 0)
+	found := false
+	for _, rule := range richRulesFromSettings(settings) {
+		if normalizeRuleText(rule) == normalizeRuleText(richRule) {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if add {
+		if found {
+			return nil
+		}
+		rules = append(rules, richRule)
+	} else if !found {
+		log.Printf("Rule not in policy %#v: %s", fwd.EgressPolicy, richRule)
+		return nil
+	}
+	log.Printf("Setting %d rich rules of policy %#v (permanent=%v)", len(rules), fwd.EgressPolicy, permanent)
+	settings["rich_rules"] = dbus.MakeVariant(rules)
+	return fwd.setPolicySettings(settings, permanent)
+}
+
+// EnsureEgressPolicy checks that the egress policy is active. Missing policy is created in permanent configuration,
+// but firewalld is not reloaded, as that would flush runtime rules of other tools: it is up to the admin to reload.
+func (fwd *FirewallDControl) EnsureEgressPolicy() error {
+	var policyNames []string
+	if err := fwd.FwD1.Call(fwd1Interface+".policy.getPolicies", 0).Store(&policyNames); err != nil {
+		return err
+	}
+	for _, name := range policyNames {
+		if name == fwd.EgressPolicy {
+			return nil
+		}
+	}
+	config := fwd.Connection.Object(fwd1Interface, fwd1ConfigPath)
+	if err := config.Call(fwd1Interface+".config.getPolicyNames", 0).Store(&policyNames); err != nil {
+		return err
+	}
+	for _, name := range policyNames {
+		if name == fwd.EgressPolicy {
+			return fmt.Errorf("policy %#v is not active, reload firewalld to activate it", fwd.EgressPolicy)
+		}
+	}
+	log.Printf("Creating egress policy %#v in permanent configuration", fwd.EgressPolicy)
+	settings := map[string]dbus.Variant{
+		"short":         dbus.MakeVariant("OpenC2 egress"),
+		"description":   dbus.MakeVariant("Egress rules managed by firewalld-oc2-client"),
+		"ingress_zones": dbus.MakeVariant([]string{"HOST"}),
+		"egress_zones":  dbus.MakeVariant([]string{"ANY"}),
+		"target":        dbus.MakeVariant("CONTINUE"),
+	}
+	var policyPath dbus.ObjectPath
+	if err := config.Call(fwd1Interface+".config.addPolicy", 0, fwd.EgressPolicy, settings).Store(&policyPath); err != nil {
+		return err
+	}
+	return fmt.Errorf("policy %#v created, reload firewalld to activate it", fwd.EgressPolicy)
+}
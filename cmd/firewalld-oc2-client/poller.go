@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+const (
+	PollModeAuto     = "auto"
+	PollModeSSE      = "sse"
+	PollModeLongPoll = "longpoll"
+	PollModePoll     = "poll"
+)
+
+// commandPoller gets commands from the server and passes them to the actuator.
+// In auto mode it tries Server-Sent Events first, then long-polling, and falls back to polling every Interval.
+type commandPoller struct {
+	Server      string
+	AssetID     string
+	NamedGroups string
+	AssetTuple  string
+	Mode        string
+	Interval    time.Duration
+	Wait        time.Duration
+	BatchSize   int
+	Actuator    *OpenC2Actuator
+	mode        string
+	// registered is set after features have been registered with the server
+	registered bool
+	// assetIDLock guards changes of AssetID made by the poller against reads from other goroutines
+	assetIDLock sync.Mutex
+}
+
+// serverURL returns server URL with query parameters added
+func (p *commandPoller) serverURL(params map[string]string) (string, error) {
+	serverURL, err := url.Parse(p.Server)
+	if err != nil {
+		return "", err
+	}
+	query := serverURL.Query()
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	serverURL.RawQuery = query.Encode()
+	return serverURL.String(), nil
+}
+
+func (p *commandPoller) newRequest() (*http.Request, error) {
+	requestURL := p.Server
+	accept := openc2.OpenC2CommandType
+	if p.BatchSize > 0 && p.mode != PollModeSSE {
+		var err error
+		if requestURL, err = p.serverURL(map[string]string{"batch": strconv.Itoa(p.BatchSize)}); err != nil {
+			return nil, err
+		}
+		accept = openc2.OpenC2CommandBatchType + ", " + accept
+	}
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = p.assetHeader()
+	req.Header.Set("User-Agent", userAgent)
+	switch p.mode {
+	case PollModeSSE:
+		req.Header.Set("Accept", openc2.EventStreamType+", "+openc2.OpenC2CommandType)
+	case PollModeLongPoll:
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Prefer", fmt.Sprintf("wait=%d", int(p.Wait.Seconds())))
+	default:
+		req.Header.Set("Accept", accept)
+	}
+	return req, nil
+}
+
+// assetHeader returns header with asset ID and specifiers of the asset, safe to call from other goroutines
+func (p *commandPoller) assetHeader() http.Header {
+	header := make(http.Header)
+	p.assetIDLock.Lock()
+	if p.AssetID != "" {
+		header.Set(openc2.OpenC2AssetIDHeader, p.AssetID)
+	}
+	p.assetIDLock.Unlock()
+	if p.NamedGroups != "" {
+		header.Set(openc2.OpenC2NamedGroupHeader, p.NamedGroups)
+	}
+	if p.AssetTuple != "" {
+		header.Set(openc2.OpenC2AssetTupleHeader, p.AssetTuple)
+	}
+	return header
+}
+
+// handleAssetID takes asset ID assigned by the server, and registers actuator features after the first response,
+// when the asset ID changes and whenever the server asks for them
+func (p *commandPoller) handleAssetID(resp *http.Response) {
+	register := !p.registered || resp.Header.Get(openc2.OpenC2RegisterHeader) == "features"
+	if responseAssetID := resp.Header.Get(openc2.OpenC2AssetIDHeader); responseAssetID != "" {
+		log.Printf("Asset ID set to %#v", responseAssetID)
+		p.assetIDLock.Lock()
+		p.AssetID = responseAssetID
+		p.assetIDLock.Unlock()
+		register = true
+	}
+	if register {
+		if err := registerFeatures(p.Server, p.assetHeader(), p.Actuator.Features()); err != nil {
+			log.Printf("Could not register features: %s", err)
+			return
+		}
+		p.registered = true
+	}
+}
+
+// ReportDrift reports rules reinstalled by the actuator to the server, safe to call from other goroutines
+func (p *commandPoller) ReportDrift(report *openc2.OpenC2Response) {
+	if err := reportDrift(p.Server, p.assetHeader(), report); err != nil {
+		log.Printf("Could not report drift to server: %s", err)
+	}
+}
+
+// processCommand executes command and acknowledges its queue index, if known (index >= 0)
+func (p *commandPoller) processCommand(data []byte, index int) {
+	if oc2cmd := p.parseCommand(data); oc2cmd != nil {
+		p.execute(*oc2cmd)
+	}
+	if index >= 0 {
+		if err := p.ack(index); err != nil {
+			log.Printf("Could not acknowledge command %d: %s", index, err)
+		}
+	}
+}
+
+// processBatch executes batch of commands in queue order and acknowledges the highest index processed
+func (p *commandPoller) processBatch(data []byte) {
+	// commands are parsed one by one, so an invalid one doesn't prevent executing the rest
+	var batch []struct {
+		Index   int             `json:"index"`
+		Command json.RawMessage `json:"command"`
+	}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		log.Printf("Failed to parse command batch: %s: %#v", err, string(data))
+		return
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Index < batch[j].Index })
+	log.Printf("Processing batch of %d commands", len(batch))
+	lastIndex := -1
+	var commands []openc2.OpenC2Command
+	for _, queued := range batch {
+		if len(queued.Command) > 0 {
+			if oc2cmd := p.parseCommand(queued.Command); oc2cmd != nil {
+				commands = append(commands, *oc2cmd)
+			}
+		}
+		lastIndex = queued.Index
+	}
+	p.executeBatch(commands)
+	if lastIndex >= 0 {
+		if err := p.ack(lastIndex); err != nil {
+			log.Printf("Could not acknowledge commands up to %d: %s", lastIndex, err)
+		}
+	}
+}
+
+// ack tells the server that commands up to queue index have been processed
+func (p *commandPoller) ack(index int) error {
+	ackURL, err := p.serverURL(map[string]string{"ack": strconv.Itoa(index)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", ackURL, nil)
+	if err != nil {
+		return err
+	}
+	if p.AssetID != "" {
+		req.Header.Set(openc2.OpenC2AssetIDHeader, p.AssetID)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status from server: %s", resp.Status)
+	}
+	return nil
+}
+
+// parseCommand parses and validates command, answering it with error response if it is invalid and has an ID
+func (p *commandPoller) parseCommand(data []byte) *openc2.OpenC2Command {
+	var oc2cmd openc2.OpenC2Command
+	err := json.Unmarshal(data, &oc2cmd)
+	if err == nil {
+		return &oc2cmd
+	}
+	log.Printf("Failed to parse command: %s: %#v", err, string(data))
+	var header struct {
+		ID   string `json:"id"`
+		Args struct {
+			ResponseRequested openc2.OpenC2ResponseRequested `json:"response_requested"`
+		} `json:"args"`
+	}
+	if json.Unmarshal(data, &header) == nil && header.ID != "" && header.Args.ResponseRequested != openc2.ResponseRequestedNone {
+		if err := postResponse(p.Server, p.AssetID, header.ID, errorResponse(err)); err != nil {
+			log.Printf("Could not send response to %#v: %s", header.ID, err)
+		}
+	}
+	return nil
+}
+
+// execute passes command to the actuator and sends back the response. Command with ID which has been executed
+// already only gets the previous response sent again.
+func (p *commandPoller) execute(oc2cmd openc2.OpenC2Command) {
+	p.executeBatch([]openc2.OpenC2Command{oc2cmd})
+}
+
+// executeBatch executes commands not processed yet, each in its own transaction so that a failed command doesn't
+// undo the unrelated ones, and sends responses to all of them
+func (p *commandPoller) executeBatch(commands []openc2.OpenC2Command) {
+	responses := make([]*openc2.OpenC2Response, len(commands))
+	for i, oc2cmd := range commands {
+		if oc2resp, seen := p.Actuator.ProcessedResponse(oc2cmd.ID); seen {
+			log.Printf("Command %#v already processed, not executing again", oc2cmd.ID)
+			responses[i] = oc2resp
+			continue
+		}
+		oc2resp, err := p.Actuator.OpenC2Act(oc2cmd)
+		if err != nil {
+			log.Printf("Command %#v failed: %s", oc2cmd.ID, err)
+			oc2resp = errorResponse(err)
+		}
+		if oc2cmd.ID != "" {
+			if err := p.Actuator.RecordProcessed(oc2cmd.ID, oc2resp); err != nil {
+				log.Printf("Could not save processed command %#v: %s", oc2cmd.ID, err)
+			}
+		}
+		responses[i] = oc2resp
+	}
+	for i, oc2cmd := range commands {
+		if oc2cmd.ID != "" && oc2cmd.ResponseRequested() != openc2.ResponseRequestedNone {
+			if err := postResponse(p.Server, p.AssetID, oc2cmd.ID, responses[i]); err != nil {
+				log.Printf("Could not send response to %#v: %s", oc2cmd.ID, err)
+			}
+		}
+	}
+}
+
+// readEvents processes commands from Server-Sent Events stream until it ends
+func (p *commandPoller) readEvents(body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxRuleFileSize)
+	var data []string
+	index := -1
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				p.processCommand([]byte(strings.Join(data, "\n")), index)
+				data = nil
+			}
+			index = -1
+		case strings.HasPrefix(line, "id:"):
+			if id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "id:"))); err == nil {
+				index = id
+			}
+		case strings.HasPrefix(line, ":"):
+			// comment, used for keep-alive
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+func hasMediaType(resp *http.Response, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	expected, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == expected
+}
+
+// pollOnce sends one request to the server, returns time to wait before the next one
+func (p *commandPoller) pollOnce() time.Duration {
+	req, err := p.newRequest()
+	if err != nil {
+		log.Fatal("Cannot create request: ", err)
+	}
+	log.Printf("Sending request for data (asset-id=%#v, mode=%s)", p.AssetID, p.mode)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error getting data from OpenC2 server: %s", err)
+		return p.Interval
+	}
+	defer resp.Body.Close()
+	log.Printf("Response from server: %#v", resp)
+	p.handleAssetID(resp)
+	if resp.StatusCode == http.StatusOK && hasMediaType(resp, openc2.EventStreamType) {
+		if err := p.readEvents(resp.Body); err != nil {
+			log.Printf("Event stream broken: %s", err)
+			return p.Interval
+		}
+		log.Printf("Event stream closed by server")
+		return time.Second
+	}
+	if p.mode == PollModeSSE && p.Mode == PollModeAuto {
+		log.Printf("Server does not support event streams, trying long-polling")
+		p.mode = PollModeLongPoll
+	}
+	if resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Print("Cannot read body: ", err)
+			return p.Interval
+		}
+		if hasMediaType(resp, openc2.OpenC2CommandBatchType) {
+			p.processBatch(body)
+		} else {
+			index, err := strconv.Atoi(resp.Header.Get(openc2.OpenC2QueueIndexHeader))
+			if err != nil {
+				index = -1
+			}
+			p.processCommand(body, index)
+		}
+		return 0
+	}
+	if p.mode == PollModeLongPoll {
+		if resp.Header.Get("Preference-Applied") != "" {
+			return 0
+		}
+		if p.Mode == PollModeAuto {
+			log.Printf("Server does not support long-polling, polling every %s", p.Interval)
+			p.mode = PollModePoll
+		}
+	}
+	return p.Interval
+}
+
+// Run polls the server forever
+func (p *commandPoller) Run() {
+	p.mode = p.Mode
+	if p.mode == PollModeAuto {
+		p.mode = PollModeSSE
+	}
+	for {
+		if delay := p.pollOnce(); delay > 0 {
+			log.Printf("Sleeping %s before next run..", delay)
+			time.Sleep(delay)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// scheduledCommand is an allow/deny command with start_time in the future or stop_time set
+type scheduledCommand struct {
+	Command    *openc2.OpenC2Command `json:"command"`
+	RuleNumber float64               `json:"rule_number"`
+	StartTime  time.Time             `json:"start_time"`
+	StopTime   time.Time             `json:"stop_time"`
+	Active     bool                  `json:"active"`
+}
+
+type ruleNumberEntry struct {
+	RuleNumber float64        `json:"rule_number"`
+	Rule       *FirewallDRule `json:"rule"`
+}
+
+// maxProcessedCommands limits the number of command IDs remembered to recognize redelivered commands
+const maxProcessedCommands = 1000
+
+// processedCommand is ID of an executed command with the response sent to it
+type processedCommand struct {
+	ID       string                 `json:"id"`
+	Response *openc2.OpenC2Response `json:"response"`
+}
+
+type clientState struct {
+	Rules     []ruleNumberEntry   `json:"rules"`
+	Schedule  []*scheduledCommand `json:"schedule"`
+	Processed []processedCommand  `json:"processed,omitempty"`
+}
+
+// LoadState reads rule numbers and scheduled commands from fileName and reconciles them with the backend,
+// missing file is not an error
+func (act *OpenC2Actuator) LoadState(fileName string) error {
+	act.lock.Lock()
+	defer act.lock.Unlock()
+	act.StateFile = fileName
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		log.Printf("State file %#v does not exist yet", fileName)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state clientState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	act.schedule = state.Schedule
+	act.processed = state.Processed
+	for _, entry := range state.Rules {
+		act.ruleIdMap[entry.RuleNumber] = entry.Rule
+	}
+	log.Printf("Loaded %d rule numbers and %d scheduled commands from %#v", len(act.ruleIdMap), len(act.schedule), fileName)
+	return act.reconcileRuleNumbers()
+}
+
+// reconcileRuleNumbers forgets rule numbers of rules which are not active in the backend anymore
+func (act *OpenC2Actuator) reconcileRuleNumbers() error {
+	activeRules, err := act.Backend.ListRules()
+	if err != nil {
+		return err
+	}
+	ruleIds := map[string]map[string]float64{
+		DirectionIngress: act.ruleIdsByText(false),
+		DirectionEgress:  act.ruleIdsByText(true),
+	}
+	active := make(map[float64]bool)
+	for _, activeRule := range activeRules {
+		if ruleId, ok := ruleIds[activeRule.Direction][normalizeRuleText(activeRule.Rule)]; ok {
+			active[ruleId] = true
+		}
+	}
+	changed := false
+	for ruleId, rule := range act.ruleIdMap {
+		if !active[ruleId] {
+			log.Printf("Rule number %v not active anymore: %s", ruleId, rule)
+			delete(act.ruleIdMap, ruleId)
+			changed = true
+		}
+	}
+	if changed {
+		return act.saveState()
+	}
+	return nil
+}
+
+func (act *OpenC2Actuator) saveState() error {
+	if act.StateFile == "" {
+		return nil
+	}
+	state := clientState{Schedule: act.schedule, Processed: act.processed}
+	for ruleId, rule := range act.ruleIdMap {
+		state.Rules = append(state.Rules, ruleNumberEntry{RuleNumber: ruleId, Rule: rule})
+	}
+	sort.Slice(state.Rules, func(i, j int) bool { return state.Rules[i].RuleNumber < state.Rules[j].RuleNumber })
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := act.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, act.StateFile)
+}
+
+// ProcessedResponse returns response to a command with the same ID if it has been executed already
+func (act *OpenC2Actuator) ProcessedResponse(commandID string) (*openc2.OpenC2Response, bool) {
+	act.lock.Lock()
+	defer act.lock.Unlock()
+	for _, pc := range act.processed {
+		if pc.ID == commandID {
+			return pc.Response, true
+		}
+	}
+	return nil, false
+}
+
+// RecordProcessed remembers command ID and response, so that redelivered command is not executed again
+func (act *OpenC2Actuator) RecordProcessed(commandID string, resp *openc2.OpenC2Response) error {
+	act.lock.Lock()
+	defer act.lock.Unlock()
+	act.processed = append(act.processed, processedCommand{ID: commandID, Response: resp})
+	if len(act.processed) > maxProcessedCommands {
+		act.processed = act.processed[len(act.processed)-maxProcessedCommands:]
+	}
+	return act.saveState()
+}
+
+func (act *OpenC2Actuator) scheduleCommand(sc *scheduledCommand) error {
+	act.schedule = append(act.schedule, sc)
+	return act.saveState()
+}
+
+// unscheduleRuleNumber drops scheduled commands with rule number ruleId, returns true if one of them was not active yet
+func (act *OpenC2Actuator) unscheduleRuleNumber(ruleId float64) (pending bool) {
+	kept := make([]*scheduledCommand, 0, len(act.schedule))
+	for _, sc := range act.schedule {
+		if sc.RuleNumber != ruleId {
+			kept = append(kept, sc)
+		} else if !sc.Active {
+			pending = true
+		}
+	}
+	if len(kept) != len(act.schedule) {
+		act.schedule = kept
+		if err := act.saveState(); err != nil {
+			log.Printf("Could not save schedule: %s", err)
+		}
+	}
+	return
+}
+
+// processSchedule activates commands which start time has come and forgets the ones which stop time has passed
+func (act *OpenC2Actuator) processSchedule(now time.Time) {
+	changed := false
+	pending := act.schedule[:0]
+	for _, sc := range act.schedule {
+		expired := !sc.StopTime.IsZero() && !now.Before(sc.StopTime)
+		rule, _, _, err := act.ruleFromCommand(sc.Command)
+		if err != nil {
+			log.Printf("Dropping unusable scheduled command %#v: %s", sc.Command, err)
+			changed = true
+			continue
+		}
+		switch {
+		case expired:
+			// backend with timeouts removes the runtime ingress rule itself, but not the permanent or egress ones
+			log.Printf("Scheduled rule expired: %s", rule)
+			if sc.Active && (!act.Backend.Capabilities().Timeout || rule.persistent || rule.egress()) {
+				if err := act.Backend.RemoveRule(rule); err != nil {
+					log.Printf("Could not fully remove expired rule %s: %s", rule, err)
+				}
+			}
+			delete(act.ruleIdMap, sc.RuleNumber)
+			changed = true
+			continue
+		case !sc.Active && !now.Before(sc.StartTime):
+			log.Printf("Activating scheduled rule: %s", rule)
+			if err := act.activateRule(rule, sc.StopTime); err != nil {
+				log.Printf("Could not activate scheduled rule %s: %s", rule, err)
+			} else {
+				act.ruleIdMap[sc.RuleNumber] = rule
+				sc.Active = true
+			}
+			changed = true
+		}
+		if sc.Active && sc.StopTime.IsZero() {
+			// nothing left to do with permanent rule
+			continue
+		}
+		pending = append(pending, sc)
+	}
+	act.schedule = pending
+	if changed {
+		if err := act.saveState(); err != nil {
+			log.Printf("Could not save schedule: %s", err)
+		}
+	}
+}
+
+// RunScheduler processes scheduled commands every interval, never returns
+func (act *OpenC2Actuator) RunScheduler(interval time.Duration) {
+	for {
+		act.lock.Lock()
+		act.processSchedule(time.Now())
+		act.lock.Unlock()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+// NotifyChanges subscribes to firewalld signals of reload, addition and removal of rich rules in the zone and removal
+// of entries from managed ipsets. Changes to the egress policy have no signals and are found by periodic
+// reconciliation only.
+func (fwd *FirewallDControl) NotifyChanges(changed func(reason string)) error {
+	for _, iface := range []string{fwd1Interface, fwd1Interface + ".zone", fwd1Interface + ".ipset"} {
+		match := fmt.Sprintf("type='signal',sender='%s',interface='%s'", fwd1Interface, iface)
+		if err := fwd.Connection.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match).Err; err != nil {
+			return err
+		}
+	}
+	signals := make(chan *dbus.Signal, 64)
+	fwd.Connection.Signal(signals)
+	go func() {
+		for signal := range signals {
+			var name string
+			if len(signal.Body) > 0 {
+				name, _ = signal.Body[0].(string)
+			}
+			switch signal.Name {
+			case fwd1Interface + ".Reloaded":
+				changed("firewalld reload")
+			case fwd1Interface + ".zone.RichRuleAdded":
+				if name == fwd.Zone && len(signal.Body) > 1 {
+					changed(fmt.Sprintf("addition of rich rule %s", signal.Body[1]))
+				}
+			case fwd1Interface + ".zone.RichRuleRemoved":
+				if name == fwd.Zone && len(signal.Body) > 1 {
+					changed(fmt.Sprintf("removal of rich rule %s", signal.Body[1]))
+				}
+			case fwd1Interface + ".ipset.EntryRemoved":
+				if fwd.IPSetPrefix != "" && strings.HasPrefix(name, fwd.IPSetPrefix+"-") && len(signal.Body) > 1 {
+					changed(fmt.Sprintf("removal of %s from ipset %s", signal.Body[1], name))
+				}
+			}
+		}
+		log.Print("D-Bus signal channel closed")
+	}()
+	return nil
+}
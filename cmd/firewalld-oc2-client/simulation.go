@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// SimulatedFirewall is in-memory backend recording the rules it would install, for testing command flows
+// without root, firewalld or D-Bus. Rules are listed in firewalld rich rule syntax and have its limitations.
+type SimulatedFirewall struct {
+	lock  sync.Mutex
+	rules []simulatedRule
+}
+
+type simulatedRule struct {
+	rule   *FirewallDRule
+	egress bool
+}
+
+// SimulatedPacket is 5-tuple of a packet, incoming or outgoing (Egress), with ICMP type name for icmp protocol
+type SimulatedPacket struct {
+	Egress             bool
+	Protocol           string
+	ICMPType           string
+	SourceAddress      net.IP
+	SourcePort         int
+	DestinationAddress net.IP
+	DestinationPort    int
+}
+
+func NewSimulatedFirewall() *SimulatedFirewall {
+	return &SimulatedFirewall{}
+}
+
+func (sim *SimulatedFirewall) find(rule *FirewallDRule, egress bool) int {
+	text := normalizeRuleText(rule.richRule(egress))
+	for i, r := range sim.rules {
+		if r.egress == egress && normalizeRuleText(r.rule.richRule(egress)) == text {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddRule installs all parts of the rule, failing like firewalld with ALREADY_ENABLED without installing any
+// if a part is installed already
+func (sim *SimulatedFirewall) AddRule(rule *FirewallDRule, timeout int) error {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	log.Printf("Simulating rule: %s (direction=%#v)", rule, rule.direction)
+	var added []simulatedRule
+	for _, single := range rule.split() {
+		for _, egress := range []bool{false, true} {
+			if egress && rule.egress() || !egress && rule.ingress() {
+				if sim.find(single, egress) >= 0 {
+					return fmt.Errorf("ALREADY_ENABLED: %s", single.richRule(egress))
+				}
+				added = append(added, simulatedRule{rule: single, egress: egress})
+			}
+		}
+	}
+	sim.rules = append(sim.rules, added...)
+	return nil
+}
+
+// RemoveRule removes all parts of the rule, failing like firewalld if a part is not installed
+func (sim *SimulatedFirewall) RemoveRule(rule *FirewallDRule) (err error) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	log.Printf("Simulating removal of rule: %s (direction=%#v)", rule, rule.direction)
+	for _, single := range rule.split() {
+		for _, egress := range []bool{false, true} {
+			if egress && rule.egress() || !egress && rule.ingress() {
+				if i := sim.find(single, egress); i >= 0 {
+					sim.rules = append(sim.rules[:i], sim.rules[i+1:]...)
+				} else if err == nil {
+					err = fmt.Errorf("rule not installed: %s", single.richRule(egress))
+				}
+			}
+		}
+	}
+	return
+}
+
+func (sim *SimulatedFirewall) ListRules() ([]BackendRule, error) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	var ret []BackendRule
+	for _, r := range sim.rules {
+		direction := DirectionIngress
+		if r.egress {
+			direction = DirectionEgress
+		}
+		ret = append(ret, BackendRule{Rule: r.rule.richRule(r.egress), Direction: direction})
+	}
+	return ret, nil
+}
+
+func (sim *SimulatedFirewall) RuleText(rule *FirewallDRule, egress bool) string {
+	return rule.richRule(egress)
+}
+
+func (sim *SimulatedFirewall) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Egress: true, Persistent: true, ICMPType: true}
+}
+
+// addressMatches checks if ip is the address or in the network, empty address matches anything
+func addressMatches(address string, ip net.IP) bool {
+	if address == "" {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		return network.Contains(ip)
+	}
+	return net.ParseIP(address).Equal(ip)
+}
+
+func (r simulatedRule) matches(packet SimulatedPacket) bool {
+	if r.egress != packet.Egress {
+		return false
+	}
+	source, destination := r.rule.sourceAddress, r.rule.destinationAddress
+	if r.rule.netTarget && r.egress {
+		source, destination = "", r.rule.sourceAddress
+	}
+	for _, ip := range []net.IP{packet.SourceAddress, packet.DestinationAddress} {
+		if ip == nil {
+			continue
+		}
+		if r.rule.family == "ipv4" && ip.To4() == nil || r.rule.family == "ipv6" && ip.To4() != nil {
+			return false
+		}
+	}
+	if !addressMatches(source, packet.SourceAddress) || !addressMatches(destination, packet.DestinationAddress) {
+		return false
+	}
+	if r.rule.protocol != "" && r.rule.protocol != packet.Protocol {
+		return false
+	}
+	if r.rule.icmpType != "" && r.rule.icmpType != packet.ICMPType {
+		return false
+	}
+	if len(r.rule.sourcePort) != 0 && !r.rule.sourcePort.Contains(packet.SourcePort) {
+		return false
+	}
+	if len(r.rule.destinationPort) != 0 && !r.rule.destinationPort.Contains(packet.DestinationPort) {
+		return false
+	}
+	return true
+}
+
+// Evaluate returns policy of the rule deciding about the packet, deny rules taking precedence over allow like in
+// firewalld. Packet not matched by any rule is left to the rest of the firewall (matched is false).
+func (sim *SimulatedFirewall) Evaluate(packet SimulatedPacket) (policy FwDPolicy, matched bool) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	for _, r := range sim.rules {
+		if !r.matches(packet) {
+			continue
+		}
+		if r.rule.policy != FwDPolicyAccept {
+			return r.rule.policy, true
+		}
+		policy, matched = r.rule.policy, true
+	}
+	return
+}
+
+// Accepts returns true unless packet is dropped or rejected by a rule
+func (sim *SimulatedFirewall) Accepts(packet SimulatedPacket) bool {
+	policy, matched := sim.Evaluate(packet)
+	return !matched || policy == FwDPolicyAccept
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+func simulatedAct(t *testing.T, act *OpenC2Actuator, command string) *openc2.OpenC2Response {
+	var oc2cmd openc2.OpenC2Command
+	if err := json.Unmarshal([]byte(command), &oc2cmd); err != nil {
+		t.Fatalf("Cannot parse command %s: %s", command, err)
+	}
+	resp, err := act.OpenC2Act(oc2cmd)
+	if err != nil {
+		t.Fatalf("Command %s failed: %s", command, err)
+	}
+	return resp
+}
+
+func TestSimulatedFirewall(t *testing.T) {
+	sim := NewSimulatedFirewall()
+	act := NewOpenC2Actuator(sim)
+	ssh := SimulatedPacket{Protocol: "tcp", SourceAddress: net.ParseIP("10.1.2.3"), SourcePort: 40000,
+		DestinationAddress: net.ParseIP("192.168.0.1"), DestinationPort: 22}
+	other := ssh
+	other.SourceAddress = net.ParseIP("172.16.0.1")
+
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_net": "10.0.0.0/8"}, "args": {"slpf": {"drop_process": "false_ack"}}}`)
+	simulatedAct(t, act, `{"action": "allow", "target": {"ipv4_connection": {"src_addr": "10.1.2.3", "dst_port": 22, "protocol": "tcp"}}}`)
+	if sim.Accepts(ssh) {
+		t.Errorf("Packet %#v from denied network accepted", ssh)
+	}
+	if _, matched := sim.Evaluate(other); matched {
+		t.Errorf("Packet %#v matched unrelated rule", other)
+	}
+	outgoing := SimulatedPacket{Egress: true, Protocol: "udp", SourceAddress: net.ParseIP("192.168.0.1"),
+		DestinationAddress: net.ParseIP("10.9.9.9"), DestinationPort: 53}
+	if sim.Accepts(outgoing) {
+		t.Errorf("Packet %#v to denied network accepted", outgoing)
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 4 {
+		t.Errorf("Expected 4 rules, got %#v", rules)
+	}
+	// like firewalld, a rule with a part installed already is not added
+	if err := sim.AddRule(act.ruleIdMap[1], 0); err == nil {
+		t.Error("Installed rule added again")
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 4 {
+		t.Errorf("Expected 4 rules after adding duplicate, got %#v", rules)
+	}
+
+	x11 := other
+	x11.DestinationPort = 6005
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": [22, "6000-6010"], "protocol": "tcp"}}, "args": {"slpf": {"direction": "ingress"}}}`)
+	if sim.Accepts(x11) {
+		t.Errorf("Packet %#v to denied port range accepted", x11)
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 6 {
+		t.Errorf("Expected 6 rules, got %#v", rules)
+	}
+	simulatedAct(t, act, `{"action": "delete", "target": {"slpf:rule_number": 3}}`)
+	if !sim.Accepts(x11) {
+		t.Errorf("Packet %#v not accepted after port range rule deleted", x11)
+	}
+
+	simulatedAct(t, act, `{"action": "delete", "target": {"slpf:rule_number": 1}}`)
+	if policy, matched := sim.Evaluate(ssh); !matched || policy != FwDPolicyAccept {
+		t.Errorf("Packet %#v not accepted after deny rule deleted: %#v", ssh, policy)
+	}
+	if !sim.Accepts(outgoing) {
+		t.Errorf("Packet %#v not accepted after deny rule deleted", outgoing)
+	}
+}
+
+func TestSimulatedRules(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		richRule string
+		status   openc2.OpenC2Status
+	}{
+		{target: `{"ipv4_connection": {"src_addr": "10.0.0.1", "protocol": "icmp"}}`,
+			richRule: `rule family="ipv4" source address="10.0.0.1" protocol value="icmp" drop`},
+		{target: `{"ipv6_connection": {"protocol": "icmp", "icmp_type": "echo-request"}}`,
+			richRule: `rule family="ipv6" icmp-type name="echo-request" drop`},
+		{target: `{"ipv6_connection": {"protocol": "icmp"}}`,
+			richRule: `rule family="ipv6" protocol value="ipv6-icmp" drop`},
+		{target: `{"ipv4_connection": {"src_port": 1024, "protocol": "udp"}}`,
+			richRule: `rule family="ipv4" source-port port="1024" protocol="udp" drop`},
+		{target: `{"ipv4_net": "10.1.2.3/8"}`, richRule: `rule family="ipv4" source address="10.0.0.0/8" drop`},
+		{target: `{"ipv6_net": "2001:db8:0::1/128"}`, richRule: `rule family="ipv6" source address="2001:db8::1" drop`},
+		{target: `{"ipv4_connection": {"src_port": 1024, "dst_port": 53, "protocol": "udp"}}`, status: openc2.StatusBadRequest},
+		{target: `{"ipv4_connection": {"dst_port": 53}}`, status: openc2.StatusBadRequest},
+		{target: `{"ipv4_connection": {"dst_port": 53, "protocol": "icmp"}}`, status: openc2.StatusBadRequest},
+		{target: `{"ipv4_connection": {"icmp_type": "echo-request", "protocol": "tcp"}}`, status: openc2.StatusBadRequest},
+		{target: `{"ipv4_connection": {"protocol": "gre"}}`, status: openc2.StatusBadRequest},
+	} {
+		sim := NewSimulatedFirewall()
+		act := NewOpenC2Actuator(sim)
+		var oc2cmd openc2.OpenC2Command
+		command := `{"action": "deny", "target": ` + tc.target + `, "args": {"slpf": {"drop_process": "none", "direction": "ingress"}}}`
+		// invalid commands are rejected already when parsing, with the same status
+		err := json.Unmarshal([]byte(command), &oc2cmd)
+		if err == nil {
+			_, err = act.OpenC2Act(oc2cmd)
+		}
+		if tc.status != 0 {
+			if err == nil || errorResponse(err).Status != tc.status {
+				t.Errorf("Expected status %d for %s, got %v", tc.status, tc.target, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Command with target %s failed: %s", tc.target, err)
+			continue
+		}
+		if rules, _ := sim.ListRules(); len(rules) != 1 || rules[0].Rule != tc.richRule {
+			t.Errorf("Wrong rules for %s: %#v", tc.target, rules)
+		}
+	}
+}
+
+// faultyFirewall fails to add rules to the port, or silently ignores them with ignore set
+type faultyFirewall struct {
+	*SimulatedFirewall
+	port   int
+	ignore bool
+}
+
+func (f *faultyFirewall) AddRule(rule *FirewallDRule, timeout int) error {
+	if rule.destinationPort.Contains(f.port) {
+		if f.ignore {
+			return nil
+		}
+		return errors.New("simulated failure")
+	}
+	return f.SimulatedFirewall.AddRule(rule, timeout)
+}
+
+func TestTransactionRollback(t *testing.T) {
+	commands := func(texts ...string) (ret []openc2.OpenC2Command) {
+		for _, text := range texts {
+			var oc2cmd openc2.OpenC2Command
+			if err := json.Unmarshal([]byte(text), &oc2cmd); err != nil {
+				t.Fatalf("Cannot parse command %s: %s", text, err)
+			}
+			ret = append(ret, oc2cmd)
+		}
+		return
+	}
+	for _, ignore := range []bool{false, true} {
+		sim := &faultyFirewall{SimulatedFirewall: NewSimulatedFirewall(), port: 23, ignore: ignore}
+		act := NewOpenC2Actuator(sim)
+		simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 21, "protocol": "tcp"}}}`)
+		_, errs := act.OpenC2ActBatch(commands(
+			`{"action": "delete", "target": {"slpf:rule_number": 1}}`,
+			`{"action": "deny", "target": {"ipv4_connection": {"dst_port": 22, "protocol": "tcp"}}}`,
+			`{"action": "deny", "target": {"ipv4_connection": {"dst_port": 23, "protocol": "tcp"}}}`,
+			`{"action": "query", "target": {"properties": ["rules"]}}`,
+		))
+		for i, err := range errs[:3] {
+			if err == nil {
+				t.Errorf("Command %d of failed batch succeeded (ignore=%v)", i, ignore)
+			}
+		}
+		// query was executed before verification failed, but not after failed command
+		if (errs[3] == nil) != ignore {
+			t.Errorf("Wrong error of query in failed batch (ignore=%v): %v", ignore, errs[3])
+		}
+		if !ignore && (errs[0] != BatchRolledBack || errs[2] == BatchRolledBack) {
+			t.Errorf("Wrong errors of failed batch: %#v", errs)
+		}
+		if rules, _ := sim.ListRules(); len(rules) != 2 || len(act.ruleIdMap) != 1 || act.ruleIdMap[1] == nil {
+			t.Errorf("Rules not rolled back (ignore=%v): %#v, %#v", ignore, rules, act.ruleIdMap)
+		}
+	}
+}
+
+func TestBatchFailedCommand(t *testing.T) {
+	statuses := make(map[string]openc2.OpenC2Status)
+	acked := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ack := r.URL.Query().Get("ack"); ack != "" {
+			acked = ack
+		} else {
+			var resp openc2.OpenC2Response
+			json.NewDecoder(r.Body).Decode(&resp)
+			statuses[r.Header.Get(openc2.OpenC2CorrelationIdHeader)] = resp.Status
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	sim := NewSimulatedFirewall()
+	p := &commandPoller{Server: ts.URL, Actuator: NewOpenC2Actuator(sim)}
+	p.processBatch([]byte(`[
+		{"index": 3, "command": {"id": "stale", "action": "delete", "target": {"slpf:rule_number": 5}}},
+		{"index": 4, "command": {"id": "deny", "action": "deny", "target": {"ipv4_net": "10.0.0.0/8"}}}]`))
+	if statuses["stale"] != openc2.StatusNotFound || statuses["deny"] != openc2.StatusOK || acked != "4" {
+		t.Errorf("Wrong responses to batch: %#v, ack %#v", statuses, acked)
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 2 {
+		t.Errorf("Deny after failed delete not applied: %#v", rules)
+	}
+}
+
+// halfRemovingFirewall removes only ingress part of the first rule to the port it is asked to remove
+type halfRemovingFirewall struct {
+	*SimulatedFirewall
+	port   int
+	failed bool
+}
+
+func (f *halfRemovingFirewall) RemoveRule(rule *FirewallDRule) error {
+	if rule.destinationPort.Contains(f.port) && rule.egress() && !f.failed {
+		f.failed = true
+		ingress := *rule
+		ingress.direction = DirectionIngress
+		if err := f.SimulatedFirewall.RemoveRule(&ingress); err != nil {
+			return err
+		}
+		return errors.New("simulated failure")
+	}
+	return f.SimulatedFirewall.RemoveRule(rule)
+}
+
+func TestRollbackPartialRemoval(t *testing.T) {
+	sim := &halfRemovingFirewall{SimulatedFirewall: NewSimulatedFirewall(), port: 22}
+	act := NewOpenC2Actuator(sim)
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 22, "protocol": "tcp"}}}`)
+	var oc2cmd openc2.OpenC2Command
+	if err := json.Unmarshal([]byte(`{"action": "delete", "target": {"slpf:rule_number": 1}}`), &oc2cmd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := act.OpenC2Act(oc2cmd); err == nil {
+		t.Error("Partially failed removal succeeded")
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 2 || act.ruleIdMap[1] == nil {
+		t.Errorf("Partially removed rule not restored: %#v, %#v", rules, act.ruleIdMap)
+	}
+}
+
+func TestReinstallMissingRules(t *testing.T) {
+	sim := &faultyFirewall{SimulatedFirewall: NewSimulatedFirewall(), port: 24}
+	act := NewOpenC2Actuator(sim)
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 22, "protocol": "tcp"}}}`)
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 23, "protocol": "tcp"}}}`)
+	if missing, unmanaged, err := act.reinstallMissingRules(); err != nil || len(missing) != 0 || len(unmanaged) != 0 {
+		t.Fatalf("Changes reported without changes: %#v, %#v, %v", missing, unmanaged, err)
+	}
+	if err := sim.RemoveRule(act.ruleIdMap[2]); err != nil {
+		t.Fatal(err)
+	}
+	missing, _, err := act.reinstallMissingRules()
+	if err != nil || len(missing) != 2 || missing[0]["rule_number"] != float64(2) || missing[0]["reinstalled"] != true {
+		t.Errorf("Wrong missing rules: %#v, %v", missing, err)
+	}
+	if rules, _ := sim.ListRules(); len(rules) != 4 {
+		t.Errorf("Rules not reinstalled: %#v", rules)
+	}
+
+	// rule which fails to be added again is reported as not reinstalled
+	sim.port = 22
+	if err := sim.SimulatedFirewall.RemoveRule(act.ruleIdMap[1]); err != nil {
+		t.Fatal(err)
+	}
+	missing, _, err = act.reinstallMissingRules()
+	if err != nil || len(missing) != 2 || missing[0]["reinstalled"] != false || missing[0]["error"] == nil {
+		t.Errorf("Failed reinstall not reported: %#v, %v", missing, err)
+	}
+	delete(act.ruleIdMap, 1)
+
+	unmanagedRule := NewFirewallDRule(FwDPolicyAccept)
+	unmanagedRule.family, unmanagedRule.protocol = "ipv4", "udp"
+	if err := sim.SimulatedFirewall.AddRule(unmanagedRule, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, unmanaged, err := act.reinstallMissingRules(); err != nil || len(unmanaged) != 1 || unmanaged[0]["direction"] != DirectionIngress {
+		t.Errorf("Wrong unmanaged rules: %#v, %v", unmanaged, err)
+	}
+	if _, unmanaged, err := act.reinstallMissingRules(); err != nil || len(unmanaged) != 0 {
+		t.Errorf("Unmanaged rule reported twice: %#v, %v", unmanaged, err)
+	}
+}
+
+func TestUpdateFileSchedule(t *testing.T) {
+	sim := NewSimulatedFirewall()
+	act := NewOpenC2Actuator(sim)
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 22, "protocol": "tcp"}}, "args": {"duration": 600000}}`)
+	simulatedAct(t, act, `{"action": "deny", "target": {"ipv4_connection": {"dst_port": 23, "protocol": "tcp"}}, "args": {"duration": 600000}}`)
+	ruleFile := `[{"action": "deny", "target": {"ipv4_connection": {"dst_port": 80, "protocol": "tcp"}}},
+		{"action": "deny", "target": {"ipv4_connection": {"dst_port": 22, "protocol": "tcp"}}}]`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules.json"), []byte(ruleFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(ruleFile))
+	act.RuleDir = dir
+	hashes := `"hashes": {"sha256": "` + hex.EncodeToString(sum[:]) + `"}`
+	for _, file := range []string{`"path": "..", "name": "rules.json"`, `"path": "/etc", "name": "passwd"`,
+		`"path": "sub", "name": "../../rules.json"`} {
+		var oc2cmd openc2.OpenC2Command
+		if err := json.Unmarshal([]byte(`{"action": "update", "target": {"file": {`+file+`, `+hashes+`}}}`), &oc2cmd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := act.OpenC2Act(oc2cmd); err == nil || errorResponse(err).Status != openc2.StatusBadRequest {
+			t.Errorf("Expected status 400 for rule file outside of rule directory (%s), got %v", file, err)
+		}
+	}
+
+	var oc2cmd openc2.OpenC2Command
+	command := `{"action": "update", "target": {"file": {"path": "` + dir + `", "name": "rules.json"}}}`
+	if err := json.Unmarshal([]byte(command), &oc2cmd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := act.OpenC2Act(oc2cmd); err == nil || errorResponse(err).Status != openc2.StatusBadRequest {
+		t.Errorf("Expected status 400 for rule file without hashes, got %v", err)
+	}
+
+	simulatedAct(t, act, `{"action": "update", "target": {"file": {"name": "rules.json", `+hashes+`}}}`)
+	if len(act.schedule) != 1 || act.ruleIdMap[act.schedule[0].RuleNumber] == nil ||
+		!act.ruleIdMap[act.schedule[0].RuleNumber].destinationPort.Contains(22) {
+		t.Errorf("Wrong schedule after update: %#v, %#v", act.schedule, act.ruleIdMap)
+	}
+}
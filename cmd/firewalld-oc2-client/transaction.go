@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// txChange is a rule added to or removed from the backend in a transaction
+type txChange struct {
+	ruleId float64
+	rule   *FirewallDRule
+	added  bool
+	stop   time.Time
+}
+
+// transaction applies rule changes of one or more commands. Rule numbers and schedule are snapshotted at the start,
+// commit verifies the changed rules against rules listed by backend, and rollback undoes backend changes in
+// reverse order and restores the snapshot. Actuator lock must be held for the whole transaction.
+type transaction struct {
+	act       *OpenC2Actuator
+	ruleIdMap map[float64]*FirewallDRule
+	schedule  []*scheduledCommand
+	changes   []txChange
+}
+
+func (act *OpenC2Actuator) beginTransaction() *transaction {
+	tx := &transaction{act: act, ruleIdMap: make(map[float64]*FirewallDRule, len(act.ruleIdMap))}
+	for ruleId, rule := range act.ruleIdMap {
+		tx.ruleIdMap[ruleId] = rule
+	}
+	tx.schedule = append(tx.schedule, act.schedule...)
+	return tx
+}
+
+// stopTime returns stop time of active rule with rule number ruleId, zero if it has none
+func (tx *transaction) stopTime(ruleId float64) time.Time {
+	for _, sc := range tx.schedule {
+		if sc.Active && sc.RuleNumber == ruleId {
+			return sc.StopTime
+		}
+	}
+	return time.Time{}
+}
+
+// addRule installs the rule with rule number ruleId, until stop if it is set
+func (tx *transaction) addRule(ruleId float64, rule *FirewallDRule, stop time.Time) error {
+	if err := tx.act.activateRule(rule, stop); err != nil {
+		return err
+	}
+	tx.act.ruleIdMap[ruleId] = rule
+	tx.changes = append(tx.changes, txChange{ruleId: ruleId, rule: rule, added: true, stop: stop})
+	return nil
+}
+
+// removeRule removes rule with rule number ruleId. Partially failed removal is also undone by rollback, which
+// removes the rest of the rule before installing it again as a whole.
+func (tx *transaction) removeRule(ruleId float64, rule *FirewallDRule) error {
+	tx.changes = append(tx.changes, txChange{ruleId: ruleId, rule: rule, stop: tx.stopTime(ruleId)})
+	if err := tx.act.Backend.RemoveRule(rule); err != nil {
+		return err
+	}
+	delete(tx.act.ruleIdMap, ruleId)
+	return nil
+}
+
+// verify checks that rules added in the transaction are listed by backend and removed ones are not,
+// unless the same rule is still managed under another rule number
+func (tx *transaction) verify() error {
+	activeRules, err := tx.act.Backend.ListRules()
+	if err != nil {
+		return err
+	}
+	listed := map[string]map[string]bool{DirectionIngress: {}, DirectionEgress: {}}
+	for _, activeRule := range activeRules {
+		if listed[activeRule.Direction] != nil {
+			listed[activeRule.Direction][normalizeRuleText(activeRule.Rule)] = true
+		}
+	}
+	managed := map[string]map[string]float64{
+		DirectionIngress: tx.act.ruleIdsByText(false),
+		DirectionEgress:  tx.act.ruleIdsByText(true),
+	}
+	for _, change := range tx.changes {
+		for _, egress := range []bool{false, true} {
+			if egress && !change.rule.egress() || !egress && !change.rule.ingress() {
+				continue
+			}
+			direction := DirectionIngress
+			if egress {
+				direction = DirectionEgress
+			}
+			for _, single := range change.rule.split() {
+				text := normalizeRuleText(tx.act.Backend.RuleText(single, egress))
+				_, isManaged := managed[direction][text]
+				switch {
+				case isManaged && !listed[direction][text]:
+					return fmt.Errorf("%s rule %v not active: %s", direction, change.ruleId, text)
+				case !isManaged && listed[direction][text]:
+					return fmt.Errorf("%s rule %v still active: %s", direction, change.ruleId, text)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rollback undoes backend changes and restores rule numbers and schedule from the snapshot
+func (tx *transaction) rollback() {
+	for i := len(tx.changes) - 1; i >= 0; i-- {
+		change := tx.changes[i]
+		if change.added {
+			if err := tx.act.Backend.RemoveRule(change.rule); err != nil {
+				log.Printf("Rollback: could not remove rule %v %s: %s", change.ruleId, change.rule, err)
+			}
+			continue
+		}
+		if !change.stop.IsZero() && !change.stop.After(time.Now()) {
+			continue
+		}
+		// parts not removed would make adding fail, as in reinstallMissingRules
+		if err := tx.act.Backend.RemoveRule(change.rule); err != nil {
+			log.Printf("Rollback: removing rest of rule %v: %s", change.ruleId, err)
+		}
+		if err := tx.act.activateRule(change.rule, change.stop); err != nil {
+			log.Printf("Rollback: could not restore rule %v %s: %s", change.ruleId, change.rule, err)
+		}
+	}
+	tx.act.ruleIdMap = tx.ruleIdMap
+	tx.act.schedule = tx.schedule
+	if err := tx.act.saveState(); err != nil {
+		log.Printf("Could not save state: %s", err)
+	}
+	log.Printf("Rolled back %d rule changes", len(tx.changes))
+}
+
+// commit verifies the changes and saves the state, rolling the changes back if verification fails
+func (tx *transaction) commit() error {
+	if len(tx.changes) > 0 {
+		if err := tx.verify(); err != nil {
+			log.Printf("Verification of %d rule changes failed: %s", len(tx.changes), err)
+			tx.rollback()
+			return fmt.Errorf("changes rolled back: %s", err)
+		}
+	}
+	return tx.act.saveState()
+}
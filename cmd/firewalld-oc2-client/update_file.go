@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// maxRuleFileSize limits the size of rule file fetched with update command
+const maxRuleFileSize = 16 << 20
+
+var hashFunctions = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// fileLocation returns URL or local path of the file target, path being either a http(s) URL or a local directory.
+// Local paths are relative to ruleDir and may not resolve outside of it, no local files are read without ruleDir.
+func fileLocation(file *openc2.TargetFile, ruleDir string) (string, error) {
+	path, name := file.Path, file.Name
+	if path == "" && name == "" {
+		return "", UnknownTargetError
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if name == "" {
+			return path, nil
+		}
+		return strings.TrimSuffix(path, "/") + "/" + name, nil
+	}
+	if ruleDir == "" {
+		return "", RuleFileNotAllowed
+	}
+	ruleDir = filepath.Clean(ruleDir)
+	location := filepath.Join(path, name)
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(ruleDir, location)
+	}
+	if rel, err := filepath.Rel(ruleDir, location); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		log.Printf("Rule file %#v outside of rule directory %#v", location, ruleDir)
+		return "", RuleFileNotAllowed
+	}
+	return location, nil
+}
+
+func fetchFile(location string) ([]byte, error) {
+	var reader io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		log.Printf("Fetching rule file from %#v", location)
+		resp, err := http.DefaultClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("cannot fetch %#v: %s", location, resp.Status)
+		}
+		reader = resp.Body
+	} else {
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxRuleFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRuleFileSize {
+		return nil, fmt.Errorf("rule file %#v larger than %d bytes", location, maxRuleFileSize)
+	}
+	return data, nil
+}
+
+// verifyHashes checks data against all hashes given in the file target
+func verifyHashes(data []byte, hashes *openc2.Hashes) error {
+	for name, expected := range map[string]string{"md5": hashes.MD5, "sha1": hashes.SHA1, "sha256": hashes.SHA256} {
+		if expected == "" {
+			continue
+		}
+		newHash := hashFunctions[name]
+		h := newHash()
+		h.Write(data)
+		if hex.EncodeToString(h.Sum(nil)) != strings.ToLower(expected) {
+			log.Printf("File %s hash mismatch, expected %s", name, expected)
+			return FileHashMismatch
+		}
+	}
+	return nil
+}
+
+// parseRuleFile parses JSON array of allow/deny commands to rules indexed by insert_rule or assigned rule numbers
+func (act *OpenC2Actuator) parseRuleFile(data []byte) (map[float64]*FirewallDRule, error) {
+	var commands []*openc2.OpenC2Command
+	if err := json.Unmarshal(data, &commands); err != nil {
+		log.Printf("Cannot parse rule file: %s", err)
+		return nil, InvalidRuleFile
+	}
+	rules := make(map[float64]*FirewallDRule)
+	var unnumbered []*FirewallDRule
+	for _, cmd := range commands {
+		rule, ruleId, haveRuleId, err := act.ruleFromCommand(cmd)
+		if err != nil {
+			log.Printf("Invalid command in rule file %#v: %s", cmd, err)
+			return nil, InvalidRuleFile
+		}
+		if !haveRuleId {
+			unnumbered = append(unnumbered, rule)
+			continue
+		}
+		if _, exists := rules[ruleId]; exists {
+			log.Printf("Duplicate rule number in rule file: %v", ruleId)
+			return nil, InvalidRuleFile
+		}
+		rules[ruleId] = rule
+	}
+	var ruleId float64 = 1
+	for _, rule := range unnumbered {
+		for rules[ruleId] != nil {
+			ruleId++
+		}
+		rules[ruleId] = rule
+	}
+	return rules, nil
+}
+
+func ruleKey(rule *FirewallDRule) string {
+	data, _ := json.Marshal(rule)
+	return string(data)
+}
+
+// keptSchedule returns scheduled commands still relevant after managed rules are replaced with newRules: stop of
+// a rule left in place is kept under its new rule number, and start of a pending rule is kept unless its rule
+// number is taken by newRules. Entries are copied, as the transaction keeps the old ones for rollback.
+func (act *OpenC2Actuator) keptSchedule(newRules map[float64]*FirewallDRule) []*scheduledCommand {
+	newIds := make(map[string]float64)
+	for ruleId, rule := range newRules {
+		newIds[ruleKey(rule)] = ruleId
+	}
+	var kept []*scheduledCommand
+	for _, sc := range act.schedule {
+		entry := *sc
+		if sc.Active {
+			rule := act.ruleIdMap[sc.RuleNumber]
+			newId, ok := newIds[ruleKey(rule)]
+			if rule == nil || !ok {
+				continue
+			}
+			entry.RuleNumber = newId
+		} else if newRules[sc.RuleNumber] != nil {
+			log.Printf("Cancelling scheduled command, rule number %v is taken by rule file", sc.RuleNumber)
+			continue
+		}
+		kept = append(kept, &entry)
+	}
+	return kept
+}
+
+// replaceRules replaces all managed rules with newRules in transaction tx, leaving identical rules in place
+func (act *OpenC2Actuator) replaceRules(tx *transaction, newRules map[float64]*FirewallDRule) error {
+	schedule := act.keptSchedule(newRules)
+	oldKeys := make(map[string]bool)
+	for _, rule := range act.ruleIdMap {
+		oldKeys[ruleKey(rule)] = true
+	}
+	newKeys := make(map[string]bool)
+	for _, rule := range newRules {
+		newKeys[ruleKey(rule)] = true
+	}
+	removed, added := 0, 0
+	for ruleId, rule := range act.ruleIdMap {
+		if newKeys[ruleKey(rule)] {
+			continue
+		}
+		if err := tx.removeRule(ruleId, rule); err != nil {
+			return err
+		}
+		removed++
+	}
+	for ruleId, rule := range newRules {
+		key := ruleKey(rule)
+		if oldKeys[key] {
+			continue
+		}
+		// same rule might be listed twice in the file
+		oldKeys[key] = true
+		if err := tx.addRule(ruleId, rule, time.Time{}); err != nil {
+			return err
+		}
+		added++
+	}
+	log.Printf("Rule set replaced: %d removed, %d added, %d total", removed, added, len(newRules))
+	act.ruleIdMap = newRules
+	act.schedule = schedule
+	return nil
+}
+
+// updateFile fetches rule file from file target, verifies its hashes and replaces managed rules with its contents
+func (act *OpenC2Actuator) updateFile(tx *transaction, target openc2.OpenC2Target) (*openc2.OpenC2Response, error) {
+	file, ok := target.(*openc2.TargetFile)
+	if !ok {
+		return nil, UnknownTargetError
+	}
+	if file.Hashes == nil || *file.Hashes == (openc2.Hashes{}) {
+		return nil, FileHashMissing
+	}
+	location, err := fileLocation(file, act.RuleDir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetchFile(location)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyHashes(data, file.Hashes); err != nil {
+		return nil, err
+	}
+	rules, err := act.parseRuleFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := act.replaceRules(tx, rules); err != nil {
+		return nil, err
+	}
+	return &openc2.OpenC2Response{Status: openc2.StatusOK, StatusText: fmt.Sprintf("Rule set updated: %d rules", len(rules))}, nil
+}
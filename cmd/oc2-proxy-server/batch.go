@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// Commands are delivered at least once: queue index of the asset is not advanced until the asset acknowledges
+// the highest index it has processed with POST ?ack=<index>. Batch delivery returns all pending commands at once.
+// Plain GET of a single command acknowledges the command delivered by the previous one, so that clients which don't
+// acknowledge don't get the same commands forever.
+
+// pendingCommands returns up to limit commands addressed to the asset which are not waiting for acknowledgement,
+// modReq must be locked. Leading commands not addressed to the asset are skipped for good.
+func (rqm *OpenC2RequestMultiplexer) pendingCommands(assetID string, asset *openC2AssetRecord, limit int) []openc2.OpenC2QueuedCommand {
+	startIndex := asset.QueueIndex
+	var batch []openc2.OpenC2QueuedCommand
+	index := asset.deliveryStart(rqm.redeliveryTimeout)
+	for ; index < len(rqm.commandQueue) && len(batch) < limit; index++ {
+		cmd := rqm.commandQueue[index]
+		if !asset.accepts(assetID, cmd) {
+			if index == asset.QueueIndex {
+				asset.QueueIndex = index + 1
+			}
+			continue
+		}
+		batch = append(batch, openc2.OpenC2QueuedCommand{Index: index, Command: cmd})
+	}
+	if len(batch) > 0 {
+		asset.sentAt = time.Now()
+	}
+	asset.sentIndex = index
+	if asset.QueueIndex != startIndex {
+		if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+			log.Printf("Cannot store asset %#v: %s", assetID, err)
+		}
+	}
+	return batch
+}
+
+// batchLimit returns batch size requested with ?batch=N query parameter, limited to maxBatch
+func (rqm *OpenC2RequestMultiplexer) batchLimit(r *http.Request) int {
+	if limit, err := strconv.Atoi(r.URL.Query().Get("batch")); err == nil && limit > 0 && limit < rqm.maxBatch {
+		return limit
+	}
+	return rqm.maxBatch
+}
+
+// handleGetBatch writes pending commands of the asset as JSON array, modReq must be locked and is unlocked on return
+func (rqm *OpenC2RequestMultiplexer) handleGetBatch(w http.ResponseWriter, r *http.Request, assetID string, asset *openC2AssetRecord) {
+	limit := rqm.batchLimit(r)
+	batch := rqm.pendingCommands(assetID, asset, limit)
+	if len(batch) == 0 {
+		if wait := preferWait(r, rqm.maxWait); wait > 0 {
+			w.Header().Set("Preference-Applied", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+			rqm.waitCommand(r, wait, func() bool {
+				batch = rqm.pendingCommands(assetID, asset, limit)
+				return len(batch) > 0
+			})
+		}
+	}
+	rqm.modReq.Unlock()
+	if len(batch) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("Cannot marshal batch of %d commands: %s", len(batch), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Sending %d commands to asset %#v", len(batch), assetID)
+	w.Header().Set("Content-Type", openc2.OpenC2CommandBatchType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// implicitAck advances queue index of the asset past commands delivered but not acknowledged yet, modReq must be locked
+func (rqm *OpenC2RequestMultiplexer) implicitAck(assetID string, asset *openC2AssetRecord) {
+	if asset.sentIndex <= asset.QueueIndex {
+		return
+	}
+	log.Printf("Asset %#v implicitly acknowledged commands up to index %d", assetID, asset.sentIndex-1)
+	asset.QueueIndex = asset.sentIndex
+	if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+		log.Printf("Cannot store asset %#v: %s", assetID, err)
+	}
+}
+
+// handleAck advances queue index of the asset past the acknowledged command index
+func (rqm *OpenC2RequestMultiplexer) handleAck(w http.ResponseWriter, r *http.Request, ack string) {
+	index, err := strconv.Atoi(ack)
+	if err != nil || index < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid ack index"))
+		return
+	}
+	assetID, _ := rqm.assetIDFromRequest(r)
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	asset, ok := rqm.assets[assetID]
+	if !ok {
+		log.Printf("Ack from unknown asset %#v", assetID)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown asset"))
+		return
+	}
+	if index >= len(rqm.commandQueue) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Ack index beyond end of queue"))
+		return
+	}
+	if index >= asset.QueueIndex {
+		log.Printf("Asset %#v acknowledged commands up to index %d", assetID, index)
+		asset.QueueIndex = index + 1
+		if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+			log.Printf("Cannot store asset %#v: %s", assetID, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// openC2DriftReport is the latest report of an asset about its rules changed outside of OpenC2
+type openC2DriftReport struct {
+	Time   time.Time
+	Report *openc2.OpenC2Response
+	// Count of reports received from the asset
+	Count int
+}
+
+// handleDriftReport stores report of an asset about managed rules it found removed and reinstalled
+func (rqm *OpenC2RequestMultiplexer) handleDriftReport(w http.ResponseWriter, r *http.Request, body []byte) {
+	report := rqm.decodeAssetResponse(w, body)
+	if report == nil {
+		return
+	}
+	assetID, _ := rqm.assetIDFromRequest(r)
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	asset, ok := rqm.assets[assetID]
+	if !ok {
+		log.Printf("Drift report from unknown asset %#v", assetID)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown asset"))
+		return
+	}
+	log.Printf("WARNING: asset %#v reported drift: %s %#v", assetID, report.StatusText, report.Results)
+	count := 1
+	if asset.Drift != nil {
+		count += asset.Drift.Count
+	}
+	asset.Drift = &openC2DriftReport{Time: time.Now(), Report: report, Count: count}
+	if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+		log.Printf("Cannot store asset %#v: %s", assetID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// proxyVersions and proxyPairs are features of the proxy itself, answered even when no actuator has registered
+var proxyVersions = []string{"1.0"}
+var proxyPairs = map[string][]string{"query": {string(openc2.TargetTypeFeatures)}}
+
+// decodeAssetResponse validates and unmarshals response posted by an asset for itself, like registered features.
+// Returns nil after writing error to w.
+func (rqm *OpenC2RequestMultiplexer) decodeAssetResponse(w http.ResponseWriter, body []byte) *openc2.OpenC2Response {
+	if rqm.respSchema != nil {
+		if err := rqm.respSchema.Validate(bytes.NewReader(body)); err != nil {
+			log.Printf("Response schema validation failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Data not compliant to schema:\n%s", err)))
+			return nil
+		}
+	}
+	var resp *openc2.OpenC2Response
+	if err := json.Unmarshal(body, &resp); err != nil || resp == nil {
+		log.Print("Unmarshal error: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Can't unmarshal that"))
+		return nil
+	}
+	return resp
+}
+
+// handleRegisterFeatures stores results of features query (versions, profiles, pairs, rate_limit) advertised by an
+// asset, together with its specifiers. Unknown assets are added, as assets receiving commands over MQTT never poll.
+func (rqm *OpenC2RequestMultiplexer) handleRegisterFeatures(w http.ResponseWriter, r *http.Request, body []byte) {
+	features := rqm.decodeAssetResponse(w, body)
+	if features == nil {
+		return
+	}
+	assetID, _ := rqm.assetIDFromRequest(r)
+	if assetID == "" {
+		log.Printf("Features from asset without ID")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing asset ID"))
+		return
+	}
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	asset, ok := rqm.assets[assetID]
+	if !ok {
+		log.Printf("Registering new asset %#v", assetID)
+		asset = &openC2AssetRecord{QueueIndex: len(rqm.commandQueue)}
+		rqm.assets[assetID] = asset
+	}
+	log.Printf("Asset %#v registered features: %#v", assetID, features.Results)
+	asset.LastAccess = time.Now()
+	asset.updateSpecifiers(r)
+	asset.Features = features.Results
+	if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+		log.Printf("Cannot store asset %#v: %s", assetID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func addStrings(set map[string]bool, list interface{}) {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			set[str] = true
+		}
+	}
+}
+
+func sortedStrings(set map[string]bool) []string {
+	ret := make([]string, 0, len(set))
+	for str := range set {
+		ret = append(ret, str)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// assetFeatures aggregates features of assets the command is addressed to: union of versions, profiles and
+// pairs, and the lowest rate_limit. Returns false if the command names specific actuators and none has registered.
+func (rqm *OpenC2RequestMultiplexer) assetFeatures(cmd *openc2.OpenC2Command) (versions, profiles []string, pairs map[string][]string, rateLimit float64, found bool) {
+	versionSet := make(map[string]bool)
+	profileSet := make(map[string]bool)
+	pairSets := make(map[string]map[string]bool)
+	for _, v := range proxyVersions {
+		versionSet[v] = true
+	}
+	for action, targets := range proxyPairs {
+		pairSets[action] = make(map[string]bool)
+		for _, t := range targets {
+			pairSets[action][t] = true
+		}
+	}
+	rqm.modReq.Lock()
+	for assetID, asset := range rqm.assets {
+		if asset.Features == nil || !asset.accepts(assetID, cmd) {
+			continue
+		}
+		found = true
+		addStrings(versionSet, asset.Features["versions"])
+		addStrings(profileSet, asset.Features["profiles"])
+		if assetPairs, ok := asset.Features["pairs"].(map[string]interface{}); ok {
+			for action, targets := range assetPairs {
+				if pairSets[action] == nil {
+					pairSets[action] = make(map[string]bool)
+				}
+				addStrings(pairSets[action], targets)
+			}
+		}
+		if limit, ok := asset.Features["rate_limit"].(float64); ok && (rateLimit == 0 || limit < rateLimit) {
+			rateLimit = limit
+		}
+	}
+	rqm.modReq.Unlock()
+	if !found && len(cmd.Actuator.Profiles()) > 0 {
+		if specifiers := cmd.Actuator.SLPF(); specifiers == nil || !specifiers.IsEmpty() {
+			return
+		}
+	}
+	found = true
+	versions = sortedStrings(versionSet)
+	profiles = sortedStrings(profileSet)
+	pairs = make(map[string][]string)
+	for action, targets := range pairSets {
+		pairs[action] = sortedStrings(targets)
+	}
+	return
+}
+
+func (rqm *OpenC2RequestMultiplexer) handleActionQuery(w http.ResponseWriter, cmd *openc2.OpenC2Command) {
+	if rr := cmd.ResponseRequested(); rr != "" && rr != openc2.ResponseRequestedComplete {
+		log.Printf("failed action=query arguments.response_requested check")
+		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusBadRequest, StatusText: "response_requested != 'complete'"})
+		return
+	}
+	versions, profiles, pairs, rateLimit, found := rqm.assetFeatures(cmd)
+	if !found {
+		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusNotFound, StatusText: "No matching actuator registered"})
+		return
+	}
+	resp := openc2.OpenC2Response{Status: openc2.StatusOK}
+	if features, haveFeatures := cmd.Target.(*openc2.TargetFeatures); haveFeatures {
+		for _, f := range *features {
+			switch f {
+			case openc2.FeatureVersions:
+				resp.AddResults("versions", versions)
+			case openc2.FeatureProfiles:
+				if len(profiles) > 0 {
+					resp.AddResults("profiles", profiles)
+				}
+			case openc2.FeaturePairs:
+				resp.AddResults("pairs", pairs)
+			case openc2.FeatureRateLimit:
+				if rateLimit > 0 {
+					resp.AddResults("rate_limit", rateLimit)
+				}
+			default:
+				log.Printf("WARNING: Unkonwn features in query: %#v", f)
+
+			}
+		}
+	}
+	log.Printf("resp: %#v", resp)
+	rqm.sendOpenC2Response(w, resp)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+func TestRegisterUnknownAsset(t *testing.T) {
+	rqm := NewOpenC2RequestMultiplexer()
+	req := httptest.NewRequest("POST", "/oc2?register=features", strings.NewReader(`{"status": 200,
+		"results": {"versions": ["1.0"], "profiles": ["slpf"]}}`))
+	req.Header.Set("Content-Type", openc2.OpenC2ResponseType)
+	req.Header.Set(openc2.OpenC2AssetIDHeader, "fw1")
+	req.Header.Set(openc2.OpenC2NamedGroupHeader, "dmz")
+	w := httptest.NewRecorder()
+	rqm.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Registration not accepted: %d %s", w.Code, w.Body)
+	}
+	asset := rqm.assets["fw1"]
+	if asset == nil || asset.Features == nil || len(asset.NamedGroups) != 1 || asset.NamedGroups[0] != "dmz" {
+		t.Fatalf("Asset not registered with features and specifiers: %#v", asset)
+	}
+	if time.Since(asset.LastAccess) > rqm.activeWindow {
+		t.Errorf("Registered asset should be active, last access %s", asset.LastAccess)
+	}
+}
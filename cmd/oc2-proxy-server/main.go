@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/korc/openc2-firewalld"
 	"github.com/santhosh-tekuri/jsonschema"
@@ -26,8 +27,36 @@ func main() {
 	caCertFile := flag.String("cacert", "ca.crt", "Client CA certificate")
 	cmdSchemaFile := flag.String("cmdschema", "", "Commands JSON-schema file")
 	respSchemaFile := flag.String("respschema", "", "Responses JSON-schema file")
+	responseTimeout := flag.Duration("timeout", 30*time.Second, "Time to wait for actuator response when response_requested is 'complete'")
+	statusTTL := flag.Duration("status-ttl", time.Hour, "Time to keep responses to a command for status lookups")
+	activeWindow := flag.Duration("active", 10*time.Minute, "Time since last access for an asset to be expected to respond to new commands")
+	maxWait := flag.Duration("maxwait", 60*time.Second, "Maximum time to hold long-polling GET requests")
+	maxBatch := flag.Int("batch", 100, "Maximum number of commands returned in one batch")
+	redeliveryTimeout := flag.Duration("redeliver", 60*time.Second, "Time to wait for acknowledgement before delivering commands again")
+	mqttBroker := flag.String("mqtt", "", "MQTT broker URL to publish commands to, ex: tcp://localhost:1883 (default: HTTP only)")
+	mqttPrefix := flag.String("mqtt-prefix", openc2.MQTTCommandPrefix, "MQTT topic prefix for commands")
+	mqttClientID := flag.String("mqtt-id", "oc2-proxy-server", "MQTT client ID")
+	storeFile := flag.String("store", "", "File to persist command queue and assets in (default: memory only)")
 	flag.Parse()
 	mplx := NewOpenC2RequestMultiplexer()
+	mplx.responseTimeout = *responseTimeout
+	mplx.statusTTL = *statusTTL
+	mplx.activeWindow = *activeWindow
+	mplx.maxWait = *maxWait
+	mplx.maxBatch = *maxBatch
+	mplx.redeliveryTimeout = *redeliveryTimeout
+	if *storeFile != "" {
+		if err := mplx.UseStorage(NewFileQueueStorage(*storeFile)); err != nil {
+			log.Fatalf("Cannot load command queue from %#v: %s", *storeFile, err)
+		}
+	}
+	if *mqttBroker != "" {
+		publisher, err := newMQTTPublisher(*mqttBroker, *mqttClientID, *mqttPrefix)
+		if err != nil {
+			log.Fatalf("Cannot connect to MQTT broker %#v: %s", *mqttBroker, err)
+		}
+		mplx.mqtt = publisher
+	}
 	jsonSchemaDecoders.Register("base16", hex.DecodeString)
 	if *cmdSchemaFile != "" {
 		if sch, err := jsonschema.Compile(*cmdSchemaFile); err != nil {
@@ -37,7 +66,7 @@ func main() {
 		}
 	}
 	if *respSchemaFile != "" {
-		if sch, err := jsonschema.Compile(*cmdSchemaFile); err != nil {
+		if sch, err := jsonschema.Compile(*respSchemaFile); err != nil {
 			log.Fatalf("Cannot read response JSON schema from %#v: %s", *respSchemaFile, err)
 		} else {
 			mplx.respSchema = sch
@@ -46,10 +75,13 @@ func main() {
 	http.Handle(*oc2path, mplx)
 	http.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		mplx.modReq.Lock()
+		defer mplx.modReq.Unlock()
 		if err := json.NewEncoder(w).Encode(struct {
-			Commands []*openc2.OpenC2Command
-			Assets   map[string]*openC2AssetRecord
-		}{mplx.commandQueue, mplx.assets}); err != nil {
+			Commands  []*openc2.OpenC2Command
+			Assets    map[string]*openC2AssetRecord
+			Responses map[string]*openC2CommandStatus
+		}{mplx.commandQueue, mplx.assets, mplx.responses}); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Print("Error: ", err)
 			w.Write([]byte("Bad things happen."))
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/korc/openc2-firewalld"
+)
+
+// mqttPublishTimeout limits time to wait for the broker to acknowledge a published command
+const mqttPublishTimeout = 10 * time.Second
+
+// mqttPublisher publishes accepted commands to MQTT broker with QoS 1, in addition to the HTTP queue.
+// Commands are published in the order they are queued, by a goroutine of their own, so the producer doesn't wait
+// for the broker.
+type mqttPublisher struct {
+	client  mqtt.Client
+	prefix  string
+	lock    sync.Mutex
+	pending []*openc2.OpenC2Command
+	// wake is signalled when commands are added to pending
+	wake chan struct{}
+}
+
+func newMQTTPublisher(broker, clientID, prefix string) (*mqttPublisher, error) {
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(clientID).SetAutoReconnect(true)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Printf("Connection to MQTT broker %#v lost: %s", broker, err)
+	})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	log.Printf("Connected to MQTT broker %#v", broker)
+	mp := &mqttPublisher{client: client, prefix: prefix, wake: make(chan struct{}, 1)}
+	go mp.run()
+	return mp, nil
+}
+
+// Enqueue adds command to be published, without waiting for the broker
+func (mp *mqttPublisher) Enqueue(cmd *openc2.OpenC2Command) {
+	mp.lock.Lock()
+	mp.pending = append(mp.pending, cmd)
+	mp.lock.Unlock()
+	select {
+	case mp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes enqueued commands, never returns
+func (mp *mqttPublisher) run() {
+	for range mp.wake {
+		for {
+			mp.lock.Lock()
+			if len(mp.pending) == 0 {
+				mp.lock.Unlock()
+				break
+			}
+			cmd := mp.pending[0]
+			mp.pending = mp.pending[1:]
+			mp.lock.Unlock()
+			if err := mp.Publish(cmd); err != nil {
+				log.Printf("Cannot publish command %#v to MQTT: %s", cmd.ID, err)
+			}
+		}
+	}
+}
+
+func (mp *mqttPublisher) Publish(cmd *openc2.OpenC2Command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	topic := openc2.MQTTCommandTopic(mp.prefix, cmd)
+	log.Printf("Publishing command %#v to %#v", cmd.ID, topic)
+	token := mp.client.Publish(topic, 1, false, data)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("timeout publishing to %#v", topic)
+	}
+	return token.Error()
+}
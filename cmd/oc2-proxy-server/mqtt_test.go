@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/korc/openc2-firewalld"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker starts in-process MQTT broker on a random local port, returns its URL
+func startBroker(t *testing.T) string {
+	server := broker.New(&broker.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+func TestMQTTPublish(t *testing.T) {
+	brokerURL := startBroker(t)
+	received := make(chan mqtt.Message, 10)
+	subscriber := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID("test-subscriber"))
+	if token := subscriber.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer subscriber.Disconnect(0)
+	token := subscriber.Subscribe(openc2.MQTTCommandPrefix+"/#", 1, func(c mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	rqm := NewOpenC2RequestMultiplexer()
+	publisher, err := newMQTTPublisher(brokerURL, "test-proxy", openc2.MQTTCommandPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rqm.mqtt = publisher
+	for _, id := range []string{"cmd1", "cmd2"} {
+		req := httptest.NewRequest("POST", "/oc2", strings.NewReader(`{"id": "`+id+`", "action": "deny",
+			"target": {"ipv4_net": "10.0.0.0/8"}, "actuator": {"slpf": {"asset_id": "fw1"}}}`))
+		req.Header.Set("Content-Type", openc2.OpenC2CommandType)
+		w := httptest.NewRecorder()
+		rqm.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Command %s not accepted: %d %s", id, w.Code, w.Body)
+		}
+	}
+	for _, id := range []string{"cmd1", "cmd2"} {
+		select {
+		case msg := <-received:
+			if msg.Topic() != "oc2/cmd/device/fw1" || !strings.Contains(string(msg.Payload()), `"`+id+`"`) {
+				t.Errorf("Wrong message instead of %s: %s %s", id, msg.Topic(), msg.Payload())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Command %s not published", id)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,16 +18,183 @@ import (
 )
 
 type openC2AssetRecord struct {
-	LastAccess time.Time
-	QueueIndex int
+	LastAccess  time.Time
+	QueueIndex  int
+	CommonName  string                 `json:",omitempty"`
+	NamedGroups []string               `json:",omitempty"`
+	AssetTuple  []string               `json:",omitempty"`
+	Features    map[string]interface{} `json:",omitempty"`
+	Drift       *openC2DriftReport     `json:",omitempty"`
+	// sentIndex is the queue index after the last command sent but not acknowledged yet, at sentAt
+	sentIndex int
+	sentAt    time.Time
+}
+
+// deliveryStart returns queue index to continue delivery from. Commands sent but not acknowledged within
+// redeliveryTimeout are delivered again.
+func (asset *openC2AssetRecord) deliveryStart(redeliveryTimeout time.Duration) int {
+	if asset.sentIndex < asset.QueueIndex {
+		asset.sentIndex = asset.QueueIndex
+	} else if asset.sentIndex > asset.QueueIndex && time.Since(asset.sentAt) > redeliveryTimeout {
+		log.Printf("Commands from index %d not acknowledged in %s, redelivering", asset.QueueIndex, redeliveryTimeout)
+		asset.sentIndex = asset.QueueIndex
+	}
+	return asset.sentIndex
+}
+
+func headerList(r *http.Request, name string) (ret []string) {
+	for _, value := range r.Header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateSpecifiers sets named groups and asset tuple declared by the asset in request headers, returns true if anything changed
+func (asset *openC2AssetRecord) updateSpecifiers(r *http.Request) bool {
+	changed := false
+	if groups := headerList(r, openc2.OpenC2NamedGroupHeader); !equalStrings(groups, asset.NamedGroups) {
+		asset.NamedGroups = groups
+		changed = true
+	}
+	if tuple := headerList(r, openc2.OpenC2AssetTupleHeader); !equalStrings(tuple, asset.AssetTuple) {
+		asset.AssetTuple = tuple
+		changed = true
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if cn := r.TLS.PeerCertificates[0].Subject.CommonName; cn != asset.CommonName {
+			asset.CommonName = cn
+			changed = true
+		}
+	}
+	return changed
+}
+
+// accepts checks if command is addressed to the asset by actuator.slpf specifiers
+func (asset *openC2AssetRecord) accepts(assetID string, cmd *openc2.OpenC2Command) bool {
+	if len(cmd.Actuator.Profiles()) == 0 {
+		return true
+	}
+	specifiers := cmd.Actuator.SLPF()
+	if specifiers == nil {
+		return false
+	}
+	if id := specifiers.AssetID; id != "" && id != assetID && (asset.CommonName == "" || id != asset.CommonName) {
+		return false
+	}
+	if group := specifiers.NamedGroup; group != "" {
+		found := false
+		for _, g := range asset.NamedGroups {
+			if g == group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if tuple := specifiers.AssetTuple; tuple != nil {
+		if len(tuple) != len(asset.AssetTuple) {
+			return false
+		}
+		for i := range tuple {
+			if tuple[i] != asset.AssetTuple[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type openC2CommandStatus struct {
+	Created time.Time
+	// Expected are active assets the command was addressed to when it was queued
+	Expected  []string `json:",omitempty"`
+	Responses map[string]*openc2.OpenC2Response
+	done      chan struct{}
+}
+
+func newOpenC2CommandStatus() *openC2CommandStatus {
+	return &openC2CommandStatus{
+		Created:   time.Now(),
+		Responses: make(map[string]*openc2.OpenC2Response),
+		done:      make(chan struct{}),
+	}
+}
+
+// answered returns true if all expected assets have responded, or any asset if none was expected
+func (st *openC2CommandStatus) answered() bool {
+	if len(st.Expected) == 0 {
+		return len(st.Responses) > 0
+	}
+	for _, assetID := range st.Expected {
+		if _, ok := st.Responses[assetID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// addResponse records response from an asset, wakes up the producer waiting for responses once all have answered
+func (st *openC2CommandStatus) addResponse(assetID string, resp *openc2.OpenC2Response) {
+	wasAnswered := st.answered()
+	st.Responses[assetID] = resp
+	if !wasAnswered && st.answered() {
+		close(st.done)
+	}
+}
+
+// response returns responses of assets in results keyed by asset ID, with status they all share or 200
+// if they differ
+func (st *openC2CommandStatus) response() openc2.OpenC2Response {
+	var resp openc2.OpenC2Response
+	for assetID, assetResp := range st.Responses {
+		if resp.Results == nil {
+			resp.Status, resp.StatusText = assetResp.Status, assetResp.StatusText
+		} else if resp.Status != assetResp.Status {
+			resp.Status, resp.StatusText = openc2.StatusOK, "Actuators answered with different status"
+		}
+		resp.AddResults(assetID, assetResp)
+	}
+	return resp
 }
 
 type OpenC2RequestMultiplexer struct {
-	commandQueue []*openc2.OpenC2Command
-	assets       map[string]*openC2AssetRecord
-	modReq       *sync.Mutex
-	cmdSchema    *jsonschema.Schema
-	respSchema   *jsonschema.Schema
+	commandQueue    []*openc2.OpenC2Command
+	assets          map[string]*openC2AssetRecord
+	responses       map[string]*openC2CommandStatus
+	modReq          *sync.Mutex
+	cmdSchema       *jsonschema.Schema
+	respSchema      *jsonschema.Schema
+	responseTimeout time.Duration
+	// statusTTL is time responses to a command are kept for after it was queued
+	statusTTL time.Duration
+	// activeWindow is time since last access for an asset to be expected to respond to new commands
+	activeWindow time.Duration
+	storage      QueueStorage
+	// newCommand is closed and replaced when a command is added to the queue
+	newCommand        chan struct{}
+	maxWait           time.Duration
+	keepAliveInterval time.Duration
+	maxBatch          int
+	redeliveryTimeout time.Duration
+	mqtt              *mqttPublisher
 }
 
 func (rqm *OpenC2RequestMultiplexer) handleCORSOptions(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +212,112 @@ func (rqm *OpenC2RequestMultiplexer) handleCORSOptions(w http.ResponseWriter, r
 	return
 }
 
+func (rqm *OpenC2RequestMultiplexer) assetIDFromRequest(r *http.Request) (assetID string, useTLS bool) {
+	useTLS = r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	if useTLS {
+		assetID = base64.RawURLEncoding.EncodeToString(r.TLS.PeerCertificates[0].RawSubject)
+	} else {
+		assetID = r.Header.Get(openc2.OpenC2AssetIDHeader)
+	}
+	return
+}
+
+func (rqm *OpenC2RequestMultiplexer) handleResponse(w http.ResponseWriter, r *http.Request, body []byte) {
+	commandID := r.Header.Get(openc2.OpenC2CorrelationIdHeader)
+	if commandID == "" {
+		log.Printf("Response without %s header", openc2.OpenC2CorrelationIdHeader)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing correlation ID"))
+		return
+	}
+	if rqm.respSchema != nil {
+		if err := rqm.respSchema.Validate(bytes.NewReader(body)); err != nil {
+			log.Printf("Response schema validation failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Data not compliant to schema:\n%s", err)))
+			return
+		}
+	}
+	var oc2resp *openc2.OpenC2Response
+	if err := json.Unmarshal(body, &oc2resp); err != nil {
+		log.Print("Unmarshal error: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Can't unmarshal that"))
+		return
+	}
+	assetID, _ := rqm.assetIDFromRequest(r)
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	status, ok := rqm.responses[commandID]
+	if !ok {
+		log.Printf("Response to unknown command %#v from %#v", commandID, assetID)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown command ID"))
+		return
+	}
+	log.Printf("Response to %#v from %#v: %#v", commandID, assetID, oc2resp)
+	if asset, ok := rqm.assets[assetID]; ok {
+		asset.LastAccess = time.Now()
+	}
+	status.addResponse(assetID, oc2resp)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// waitResponse sends responses to the command once all addressed assets have answered, or responses collected
+// so far with status 102 on timeout
+func (rqm *OpenC2RequestMultiplexer) waitResponse(w http.ResponseWriter, r *http.Request, commandID string, status *openC2CommandStatus) {
+	select {
+	case <-status.done:
+		rqm.modReq.Lock()
+		resp := status.response()
+		rqm.modReq.Unlock()
+		rqm.sendOpenC2Response(w, resp)
+	case <-time.After(rqm.responseTimeout):
+		log.Printf("Timeout waiting for response to %#v", commandID)
+		rqm.modReq.Lock()
+		resp := status.response()
+		rqm.modReq.Unlock()
+		resp.Status = openc2.StatusProcessing
+		resp.StatusText = fmt.Sprintf("Command added to the queue, %d of %d actuators responded so far.",
+			len(resp.Results), len(status.Expected))
+		rqm.sendOpenC2Response(w, resp)
+	case <-r.Context().Done():
+		log.Printf("Producer went away while waiting for response to %#v", commandID)
+	}
+}
+
+// expireResponses forgets responses to commands queued more than statusTTL ago, modReq must be locked
+func (rqm *OpenC2RequestMultiplexer) expireResponses() {
+	for commandID, status := range rqm.responses {
+		if time.Since(status.Created) > rqm.statusTTL {
+			delete(rqm.responses, commandID)
+		}
+	}
+}
+
+func (rqm *OpenC2RequestMultiplexer) handleStatus(w http.ResponseWriter, commandID string) {
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	rqm.expireResponses()
+	status, ok := rqm.responses[commandID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown command ID"))
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Cannot marshal status of %#v: %s", commandID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-control", "no-cache")
+	w.Header().Set(openc2.OpenC2CorrelationIdHeader, commandID)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func (rqm *OpenC2RequestMultiplexer) handlePost(w http.ResponseWriter, r *http.Request) {
 	body := make([]byte, 0)
 	for {
@@ -69,7 +344,20 @@ func (rqm *OpenC2RequestMultiplexer) handlePost(w http.ResponseWriter, r *http.R
 	if requestId := r.Header.Get(openc2.OpenC2RequestIDHeader); requestId != "" {
 		w.Header().Set(openc2.OpenC2RequestIDHeader, requestId)
 	}
-	if ctype := r.Header.Get("Content-Type"); ctype != openc2.OpenC2CommandType {
+	if ack := r.URL.Query().Get("ack"); ack != "" {
+		rqm.handleAck(w, r, ack)
+		return
+	}
+	if ctype := r.Header.Get("Content-Type"); ctype == openc2.OpenC2ResponseType {
+		if r.URL.Query().Get("register") == "features" {
+			rqm.handleRegisterFeatures(w, r, body)
+		} else if r.URL.Query().Get("report") == "drift" {
+			rqm.handleDriftReport(w, r, body)
+		} else {
+			rqm.handleResponse(w, r, body)
+		}
+		return
+	} else if ctype != openc2.OpenC2CommandType {
 		log.Printf("Wrong Content-Type header: %#v", ctype)
 		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusBadRequest,
 			StatusText: fmt.Sprintf("Wrong Content-Type: %#v, expected %#v", ctype, openc2.OpenC2CommandType)})
@@ -87,28 +375,66 @@ func (rqm *OpenC2RequestMultiplexer) handlePost(w http.ResponseWriter, r *http.R
 	log.Printf("Unmarshalling: %#v", string(body))
 	if err := json.Unmarshal(body, &oc2cmd); err != nil {
 		log.Print("Unmarshal error: ", err)
-		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusNotImplemented, StatusText: "Can't unmarshal that"})
+		switch e := err.(type) {
+		case *openc2.ValidationError:
+			rqm.sendOpenC2Response(w, e.Response())
+		case *openc2.UnknownProfileError:
+			rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusNotImplemented, StatusText: err.Error()})
+		default:
+			rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusNotImplemented, StatusText: "Can't unmarshal that"})
+		}
 		return
 	}
-	rqm.modReq.Lock()
-	rqm.commandQueue = append(rqm.commandQueue, oc2cmd)
-	rqm.modReq.Unlock()
-	if oc2cmd.Action == openc2.ActionQuery {
+	if oc2cmd.ID == "" {
+		if requestId := r.Header.Get(openc2.OpenC2RequestIDHeader); requestId != "" {
+			oc2cmd.ID = requestId
+		} else {
+			oc2cmd.ID = RandStringBytes(16)
+		}
+	}
+	w.Header().Set(openc2.OpenC2CorrelationIdHeader, oc2cmd.ID)
+	if isFeaturesQuery(oc2cmd) {
 		rqm.handleActionQuery(w, oc2cmd)
 		return
 	}
-	sendResponse := true
-	if args, ok := oc2cmd.Args.(map[string]interface{}); ok {
-		if rr, ok := args["response_requested"]; ok {
-			log.Printf("Response Requested: %#v", rr)
-			if rr == "none" {
-				sendResponse = false
-			}
-		} else {
-			log.Printf("No response requested")
+	status := newOpenC2CommandStatus()
+	rqm.modReq.Lock()
+	rqm.expireResponses()
+	if _, exists := rqm.responses[oc2cmd.ID]; exists {
+		rqm.modReq.Unlock()
+		log.Printf("Duplicate command ID: %#v", oc2cmd.ID)
+		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusBadRequest,
+			StatusText: fmt.Sprintf("Duplicate command ID: %#v", oc2cmd.ID)})
+		return
+	}
+	if err := rqm.storage.AddCommand(oc2cmd); err != nil {
+		rqm.modReq.Unlock()
+		log.Printf("Cannot store command %#v: %s", oc2cmd, err)
+		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusInternalError, StatusText: "Cannot store command"})
+		return
+	}
+	// assets that have not been seen for a while, like ones with random IDs given to one-off clients, would only make
+	// the producer wait for the timeout
+	for assetID, asset := range rqm.assets {
+		if time.Since(asset.LastAccess) <= rqm.activeWindow && asset.accepts(assetID, oc2cmd) {
+			status.Expected = append(status.Expected, assetID)
 		}
 	}
-	if sendResponse {
+	rqm.responses[oc2cmd.ID] = status
+	rqm.commandQueue = append(rqm.commandQueue, oc2cmd)
+	rqm.notifyNewCommand()
+	if rqm.mqtt != nil {
+		rqm.mqtt.Enqueue(oc2cmd)
+	}
+	rqm.modReq.Unlock()
+	rr := oc2cmd.ResponseRequested()
+	log.Printf("Response Requested: %#v", rr)
+	if rr == openc2.ResponseRequestedComplete || oc2cmd.Action == openc2.ActionQuery {
+		log.Printf("Added to queue: %#v, waiting for response", oc2cmd)
+		rqm.waitResponse(w, r, oc2cmd.ID, status)
+		return
+	}
+	if rr != openc2.ResponseRequestedNone {
 		rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusOK, StatusText: "Command added to the queue."})
 	} else {
 		w.WriteHeader(http.StatusNoContent)
@@ -117,49 +443,13 @@ func (rqm *OpenC2RequestMultiplexer) handlePost(w http.ResponseWriter, r *http.R
 	return
 }
 
-var supportedTargets = []openc2.OpenC2TargetType{
-	openc2.TargetTypeIPv4Net,
-	openc2.TargetTypeIPv4Connection,
-	openc2.TargetTypeIPv6Net,
-	openc2.TargetTypeIPv6Connection,
-}
-
-func (rqm *OpenC2RequestMultiplexer) handleActionQuery(w http.ResponseWriter, cmd *openc2.OpenC2Command) {
-	if args, haveArgs := cmd.Args.(map[string]interface{}); haveArgs {
-		if rr, haveRR := args["response_requested"]; haveRR {
-			if rr != "complete" {
-				log.Printf("failed action=query arguments.response_requested check")
-				rqm.sendOpenC2Response(w, openc2.OpenC2Response{Status: openc2.StatusBadRequest, StatusText: "response_requested != 'complete'"})
-				return
-			}
-		}
-	}
-	resp := openc2.OpenC2Response{Status: openc2.StatusOK}
-	if target, haveTarget := cmd.Target.(openc2.OpenC2GenericTarget); haveTarget {
-		if features, haveFeatures := target["features"]; haveFeatures {
-			if flist, haveFList := features.([]interface{}); haveFList {
-				for _, f := range flist {
-					switch f {
-					case "versions":
-						resp.AddResults("versions", []string{"1.0"})
-					case "profiles":
-						resp.AddResults("profiles", []string{"slpf"})
-					case "pairs":
-						resp.AddResults("pairs", map[string]interface{}{
-							"allow": supportedTargets,
-							"deny":  supportedTargets,
-							"query": []string{"features"},
-						})
-					default:
-						log.Printf("WARNING: Unkonwn features in query: %#v", f)
-
-					}
-				}
-			}
-		}
+// isFeaturesQuery returns true for query commands answered by proxy itself instead of actuators
+func isFeaturesQuery(cmd *openc2.OpenC2Command) bool {
+	if cmd.Action != openc2.ActionQuery {
+		return false
 	}
-	log.Printf("resp: %#v", resp)
-	rqm.sendOpenC2Response(w, resp)
+	_, ok := cmd.Target.(*openc2.TargetFeatures)
+	return ok
 }
 
 func (rqm *OpenC2RequestMultiplexer) sendOpenC2Response(w http.ResponseWriter, resp openc2.OpenC2Response) {
@@ -171,46 +461,178 @@ func (rqm *OpenC2RequestMultiplexer) sendOpenC2Response(w http.ResponseWriter, r
 		data = []byte("Error")
 	}
 	w.Header().Set("Cache-control", "no-cache")
+	if st < 200 {
+		// informational status can't be the final HTTP status, it is sent in the body only
+		st = http.StatusAccepted
+	}
 	w.WriteHeader(int(st))
 	w.Write(data)
 }
 
+// nextCommand returns next command addressed to the asset and its queue index, modReq must be locked.
+// Queue index of the asset is advanced only over commands not addressed to it, the rest waits for acknowledgement.
+func (rqm *OpenC2RequestMultiplexer) nextCommand(assetID string, asset *openC2AssetRecord) (*openc2.OpenC2Command, int) {
+	batch := rqm.pendingCommands(assetID, asset, 1)
+	if len(batch) == 0 {
+		return nil, -1
+	}
+	return batch[0].Command, batch[0].Index
+}
+
+// notifyNewCommand wakes up long-polling and streaming requests, modReq must be locked
+func (rqm *OpenC2RequestMultiplexer) notifyNewCommand() {
+	close(rqm.newCommand)
+	rqm.newCommand = make(chan struct{})
+}
+
+// preferWait returns wait time requested with "Prefer: wait=N" header, limited to maxWait
+func preferWait(r *http.Request, maxWait time.Duration) time.Duration {
+	for _, prefer := range headerList(r, "Prefer") {
+		if !strings.HasPrefix(prefer, "wait=") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(strings.TrimPrefix(prefer, "wait=")); err == nil && seconds > 0 {
+			wait := time.Duration(seconds) * time.Second
+			if wait > maxWait {
+				wait = maxWait
+			}
+			return wait
+		}
+	}
+	return 0
+}
+
+// waitCommand waits until ready returns true after a new command arrives, or wait time passes.
+// modReq must be locked and stays locked on return.
+func (rqm *OpenC2RequestMultiplexer) waitCommand(r *http.Request, wait time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		notify := rqm.newCommand
+		rqm.modReq.Unlock()
+		select {
+		case <-notify:
+		case <-timer.C:
+			rqm.modReq.Lock()
+			return false
+		case <-r.Context().Done():
+			rqm.modReq.Lock()
+			return false
+		}
+		rqm.modReq.Lock()
+		if ready() {
+			return true
+		}
+	}
+}
+
+// streamCommands sends commands for the asset as Server-Sent Events until the client goes away
+func (rqm *OpenC2RequestMultiplexer) streamCommands(w http.ResponseWriter, r *http.Request, assetID string, asset *openC2AssetRecord) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming not supported by %#v", w)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Streaming commands to asset %#v", assetID)
+	w.Header().Set("Content-Type", openc2.EventStreamType)
+	w.Header().Set("Cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(rqm.keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var events [][]byte
+		rqm.modReq.Lock()
+		asset.LastAccess = time.Now()
+		batch := rqm.pendingCommands(assetID, asset, len(rqm.commandQueue))
+		for _, queued := range batch {
+			if commandData, err := json.Marshal(queued.Command); err != nil {
+				log.Printf("Cannot marshal command to data %#v: %s", queued.Command, err)
+			} else {
+				events = append(events, []byte(fmt.Sprintf("id: %d\nevent: command\ndata: %s\n\n", queued.Index, commandData)))
+			}
+		}
+		notify := rqm.newCommand
+		rqm.modReq.Unlock()
+		for _, event := range events {
+			w.Write(event)
+		}
+		flusher.Flush()
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Printf("Stream to asset %#v closed", assetID)
+			return
+		}
+	}
+}
+
 func (rqm *OpenC2RequestMultiplexer) handleGet(w http.ResponseWriter, r *http.Request) {
-	var asset *openC2AssetRecord
-	var assetID string
-	useTLS := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
-	if useTLS {
-		assetID = base64.RawURLEncoding.EncodeToString(r.TLS.PeerCertificates[0].RawSubject)
-	} else {
-		assetID = r.Header.Get(openc2.OpenC2AssetIDHeader)
+	if commandID := r.URL.Query().Get("command_id"); commandID != "" {
+		rqm.handleStatus(w, commandID)
+		return
 	}
+	var asset *openC2AssetRecord
+	assetID, useTLS := rqm.assetIDFromRequest(r)
 	rqm.modReq.Lock()
-	if gotAsset, ok := rqm.assets[assetID]; !ok {
+	gotAsset, ok := rqm.assets[assetID]
+	if !ok {
 		if !useTLS || assetID == "" {
 			assetID = RandStringBytes(16)
 		}
 		asset = &openC2AssetRecord{LastAccess: time.Now(), QueueIndex: len(rqm.commandQueue)}
 		rqm.assets[assetID] = asset
-		rqm.modReq.Unlock()
 		w.Header().Set(openc2.OpenC2AssetIDHeader, assetID)
 		log.Printf("Created new asset ID: %#v", assetID)
 	} else {
 		asset = gotAsset
-		rqm.modReq.Unlock()
 		log.Printf("Asset ID: %#v", assetID)
 	}
+	if asset.Features == nil {
+		w.Header().Set(openc2.OpenC2RegisterHeader, "features")
+	}
 
+	// Asset is stored only when it is new or its specifiers change, queue index is stored when it advances
 	asset.LastAccess = time.Now()
-	if len(rqm.commandQueue) > asset.QueueIndex {
-		nextCommand := rqm.commandQueue[asset.QueueIndex]
+	if changed := asset.updateSpecifiers(r); changed || !ok {
+		if err := rqm.storage.UpdateAsset(assetID, asset); err != nil {
+			log.Printf("Cannot store asset %#v: %s", assetID, err)
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), openc2.EventStreamType) {
+		rqm.modReq.Unlock()
+		rqm.streamCommands(w, r, assetID, asset)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), openc2.OpenC2CommandBatchType) {
+		rqm.handleGetBatch(w, r, assetID, asset)
+		return
+	}
+	rqm.implicitAck(assetID, asset)
+	nextCommand, index := rqm.nextCommand(assetID, asset)
+	if nextCommand == nil {
+		if wait := preferWait(r, rqm.maxWait); wait > 0 {
+			w.Header().Set("Preference-Applied", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+			rqm.waitCommand(r, wait, func() bool {
+				nextCommand, index = rqm.nextCommand(assetID, asset)
+				return nextCommand != nil
+			})
+		}
+	}
+	rqm.modReq.Unlock()
+	if nextCommand != nil {
 		commandData, err := json.Marshal(nextCommand)
 		if err != nil {
 			log.Printf("Cannot marshal command to data %#v: %s", nextCommand, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		asset.QueueIndex = asset.QueueIndex + 1
 		w.Header().Set("Content-Type", openc2.OpenC2CommandType)
+		w.Header().Set(openc2.OpenC2QueueIndexHeader, strconv.Itoa(index))
 		w.WriteHeader(http.StatusOK)
 		w.Write(commandData)
 	} else {
@@ -239,5 +661,36 @@ func NewOpenC2RequestMultiplexer() (rqm *OpenC2RequestMultiplexer) {
 	rqm.commandQueue = make([]*openc2.OpenC2Command, 0)
 	rqm.modReq = &sync.Mutex{}
 	rqm.assets = make(map[string]*openC2AssetRecord)
+	rqm.responses = make(map[string]*openC2CommandStatus)
+	rqm.responseTimeout = 30 * time.Second
+	rqm.statusTTL = time.Hour
+	rqm.activeWindow = 10 * time.Minute
+	rqm.storage = memoryQueueStorage{}
+	rqm.newCommand = make(chan struct{})
+	rqm.maxWait = 60 * time.Second
+	rqm.keepAliveInterval = 30 * time.Second
+	rqm.maxBatch = 100
+	rqm.redeliveryTimeout = 60 * time.Second
 	return
 }
+
+// UseStorage loads command queue and assets from storage, and keeps them updated there
+func (rqm *OpenC2RequestMultiplexer) UseStorage(storage QueueStorage) error {
+	commands, assets, err := storage.Load()
+	if err != nil {
+		return err
+	}
+	rqm.modReq.Lock()
+	defer rqm.modReq.Unlock()
+	for _, cmd := range commands {
+		rqm.commandQueue = append(rqm.commandQueue, cmd)
+		if cmd.ID != "" {
+			rqm.responses[cmd.ID] = newOpenC2CommandStatus()
+		}
+	}
+	for assetID, asset := range assets {
+		rqm.assets[assetID] = asset
+	}
+	rqm.storage = storage
+	return nil
+}
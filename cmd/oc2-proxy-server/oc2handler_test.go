@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+func TestExpectedAssets(t *testing.T) {
+	rqm := NewOpenC2RequestMultiplexer()
+	rqm.assets["fw1"] = &openC2AssetRecord{LastAccess: time.Now()}
+	rqm.assets["stale"] = &openC2AssetRecord{LastAccess: time.Now().Add(-2 * rqm.activeWindow)}
+	req := httptest.NewRequest("POST", "/oc2", strings.NewReader(`{"id": "cmd1", "action": "deny",
+		"target": {"ipv4_net": "10.0.0.0/8"}}`))
+	req.Header.Set("Content-Type", openc2.OpenC2CommandType)
+	w := httptest.NewRecorder()
+	rqm.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Command not accepted: %d %s", w.Code, w.Body)
+	}
+	status := rqm.responses["cmd1"]
+	if status == nil || len(status.Expected) != 1 || status.Expected[0] != "fw1" {
+		t.Fatalf("Only the active asset should be expected, got %#v", status)
+	}
+
+	w = httptest.NewRecorder()
+	rqm.ServeHTTP(w, httptest.NewRequest("GET", "/oc2?command_id=cmd1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Status of the command not found: %d %s", w.Code, w.Body)
+	}
+	status.Created = time.Now().Add(-2 * rqm.statusTTL)
+	w = httptest.NewRecorder()
+	rqm.ServeHTTP(w, httptest.NewRequest("GET", "/oc2?command_id=cmd1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expired status should not be found, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestImplicitAck(t *testing.T) {
+	rqm := NewOpenC2RequestMultiplexer()
+	get := func(assetID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oc2", nil)
+		req.Header.Set("Accept", openc2.OpenC2CommandType)
+		if assetID != "" {
+			req.Header.Set(openc2.OpenC2AssetIDHeader, assetID)
+		}
+		w := httptest.NewRecorder()
+		rqm.ServeHTTP(w, req)
+		return w
+	}
+	assetID := get("").Header().Get(openc2.OpenC2AssetIDHeader)
+	for _, id := range []string{"cmd1", "cmd2"} {
+		req := httptest.NewRequest("POST", "/oc2", strings.NewReader(`{"id": "`+id+`", "action": "deny",
+			"target": {"ipv4_net": "10.0.0.0/8"}}`))
+		req.Header.Set("Content-Type", openc2.OpenC2CommandType)
+		rqm.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i, id := range []string{"cmd1", "cmd2", ""} {
+		w := get(assetID)
+		if id == "" {
+			if w.Code != http.StatusNoContent {
+				t.Errorf("Expected no more commands, got %d %s", w.Code, w.Body)
+			}
+		} else if !strings.Contains(w.Body.String(), `"`+id+`"`) {
+			t.Errorf("Expected %s, got %d %s", id, w.Code, w.Body)
+		}
+		// each GET acknowledges the command returned by the previous one
+		if queueIndex := rqm.assets[assetID].QueueIndex; queueIndex != i {
+			t.Errorf("Queue index after GET of %#v is %d instead of %d", id, queueIndex, i)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+// QueueStorage persists command queue and asset records of OpenC2RequestMultiplexer
+type QueueStorage interface {
+	// Load returns previously stored commands in queue order and latest asset records
+	Load() ([]*openc2.OpenC2Command, map[string]*openC2AssetRecord, error)
+	AddCommand(cmd *openc2.OpenC2Command) error
+	UpdateAsset(assetID string, asset *openC2AssetRecord) error
+	Close() error
+}
+
+type memoryQueueStorage struct{}
+
+func (memoryQueueStorage) Load() ([]*openc2.OpenC2Command, map[string]*openC2AssetRecord, error) {
+	return nil, nil, nil
+}
+func (memoryQueueStorage) AddCommand(*openc2.OpenC2Command) error       { return nil }
+func (memoryQueueStorage) UpdateAsset(string, *openC2AssetRecord) error { return nil }
+func (memoryQueueStorage) Close() error                                 { return nil }
+
+type storageRecord struct {
+	Command *openc2.OpenC2Command `json:"command,omitempty"`
+	AssetID string                `json:"asset_id,omitempty"`
+	Asset   *openC2AssetRecord    `json:"asset,omitempty"`
+}
+
+// FileQueueStorage keeps commands and asset updates in an append-only log of JSON records,
+// compacted to one record per command and asset on Load and whenever CompactAfter records are superseded
+type FileQueueStorage struct {
+	FileName string
+	// CompactAfter is the number of superseded asset records in the log that triggers compaction
+	CompactAfter int
+	file         *os.File
+	encoder      *json.Encoder
+	// commands and assets are the live records, as written by compact
+	commands []*openc2.OpenC2Command
+	assets   map[string]*openC2AssetRecord
+	// superseded is the number of asset records in the log replaced by later ones
+	superseded int
+}
+
+func NewFileQueueStorage(fileName string) *FileQueueStorage {
+	return &FileQueueStorage{FileName: fileName, CompactAfter: 1000}
+}
+
+func (fs *FileQueueStorage) Load() (commands []*openc2.OpenC2Command, assets map[string]*openC2AssetRecord, err error) {
+	assets = make(map[string]*openC2AssetRecord)
+	if f, err := os.Open(fs.FileName); err == nil {
+		decoder := json.NewDecoder(f)
+		for {
+			var rec storageRecord
+			if err := decoder.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("WARNING: stopped reading %#v at broken record: %s", fs.FileName, err)
+				break
+			}
+			if rec.Command != nil {
+				commands = append(commands, rec.Command)
+			}
+			if rec.Asset != nil {
+				assets[rec.AssetID] = rec.Asset
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err := fs.compact(commands, assets); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Loaded %d commands and %d assets from %#v", len(commands), len(assets), fs.FileName)
+	return commands, assets, nil
+}
+
+func (fs *FileQueueStorage) compact(commands []*openc2.OpenC2Command, assets map[string]*openC2AssetRecord) error {
+	tmpFile := fs.FileName + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, cmd := range commands {
+		if err := encoder.Encode(storageRecord{Command: cmd}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for assetID, asset := range assets {
+		if err := encoder.Encode(storageRecord{AssetID: assetID, Asset: asset}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmpFile, fs.FileName); err != nil {
+		f.Close()
+		return err
+	}
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	fs.file = f
+	fs.encoder = encoder
+	fs.commands = commands
+	fs.assets = assets
+	fs.superseded = 0
+	return nil
+}
+
+func (fs *FileQueueStorage) append(rec storageRecord) error {
+	if err := fs.encoder.Encode(rec); err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *FileQueueStorage) AddCommand(cmd *openc2.OpenC2Command) error {
+	if err := fs.append(storageRecord{Command: cmd}); err != nil {
+		return err
+	}
+	fs.commands = append(fs.commands, cmd)
+	return nil
+}
+
+// UpdateAsset appends the asset record, and compacts the log when it has grown by CompactAfter superseded records,
+// as every acknowledgement and feature or drift report adds one
+func (fs *FileQueueStorage) UpdateAsset(assetID string, asset *openC2AssetRecord) error {
+	if err := fs.append(storageRecord{AssetID: assetID, Asset: asset}); err != nil {
+		return err
+	}
+	if _, ok := fs.assets[assetID]; ok {
+		fs.superseded++
+	}
+	fs.assets[assetID] = asset
+	if fs.CompactAfter > 0 && fs.superseded >= fs.CompactAfter {
+		if err := fs.compact(fs.commands, fs.assets); err != nil {
+			log.Printf("Cannot compact %#v: %s", fs.FileName, err)
+		}
+	}
+	return nil
+}
+
+func (fs *FileQueueStorage) Close() error {
+	if fs.file == nil {
+		return nil
+	}
+	return fs.file.Close()
+}
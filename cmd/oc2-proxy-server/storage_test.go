@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/korc/openc2-firewalld"
+)
+
+func TestFileQueueStorageCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "queue.json")
+	fs := NewFileQueueStorage(fileName)
+	fs.CompactAfter = 5
+	if _, _, err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var cmd openc2.OpenC2Command
+	if err := json.Unmarshal([]byte(`{"id": "cmd1", "action": "deny", "target": {"ipv4_net": "10.0.0.0/8"}}`), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AddCommand(&cmd); err != nil {
+		t.Fatal(err)
+	}
+	asset := &openC2AssetRecord{}
+	for i := 1; i <= 12; i++ {
+		asset.QueueIndex = i
+		if err := fs.UpdateAsset("fw1", asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compacted after the 6th and 11th update, followed by the 12th
+	if records := bytes.Count(data, []byte("\n")); records != 3 {
+		t.Errorf("Expected 3 records after compaction, got %d:\n%s", records, data)
+	}
+
+	fs = NewFileQueueStorage(fileName)
+	defer fs.Close()
+	commands, assets, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || commands[0].ID != "cmd1" {
+		t.Errorf("Wrong commands loaded: %#v", commands)
+	}
+	if assets["fw1"] == nil || assets["fw1"].QueueIndex != 12 {
+		t.Errorf("Wrong assets loaded: %#v", assets)
+	}
+}
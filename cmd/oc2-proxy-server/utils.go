@@ -27,6 +27,12 @@ func (lw *loggingWriter) WriteHeader(code int) {
 	lw.ResponseWriter.WriteHeader(code)
 }
 
+func (lw *loggingWriter) Flush() {
+	if flusher, ok := lw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func newLoggingWriter(w http.ResponseWriter, reqNum int) *loggingWriter {
 	return &loggingWriter{ResponseWriter: w, reqNum: reqNum}
 }
@@ -1,8 +1,24 @@
 module github.com/korc/openc2-firewalld
 
-go 1.13
+go 1.21
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/godbus/dbus v4.1.0+incompatible
+	github.com/google/nftables v0.2.1-0.20240414091927-5e242ec57806
+	github.com/mochi-mqtt/server/v2 v2.6.6
 	github.com/santhosh-tekuri/jsonschema v1.2.4
+	golang.org/x/sys v0.18.0
+)
+
+require (
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/josharian/native v1.1.0 // indirect
+	github.com/mdlayher/netlink v1.7.2 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -6,4 +6,17 @@ const (
 	OpenC2CorrelationIdHeader = "X-Correlation-Id"
 	OpenC2AssetIDHeader = "X-Openc2-Asset-Id"
 	OpenC2RequestIDHeader = "X-Request-ID"
+	OpenC2NamedGroupHeader = "X-Openc2-Named-Group"
+	OpenC2AssetTupleHeader = "X-Openc2-Asset-Tuple"
+	EventStreamType = "text/event-stream"
+	OpenC2CommandBatchType = "application/openc2-cmd-batch+json;version=1.0"
+	OpenC2QueueIndexHeader = "X-Openc2-Queue-Index"
+	// OpenC2RegisterHeader is set to "features" by the proxy when it has no features registered for the asset
+	OpenC2RegisterHeader = "X-Openc2-Register"
 )
+
+// OpenC2QueuedCommand is a command in a batch together with its index in the command queue
+type OpenC2QueuedCommand struct {
+	Index   int            `json:"index"`
+	Command *OpenC2Command `json:"command"`
+}
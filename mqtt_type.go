@@ -0,0 +1,52 @@
+package openc2
+
+import "strings"
+
+// Commands are published to MQTT topics under a prefix, by the most specific actuator specifier:
+// <prefix>/device/<asset_id>, <prefix>/group/<named_group>, <prefix>/ap/<profile> or <prefix>/all.
+// Payload is the command JSON, same as HTTP body with OpenC2CommandType.
+const (
+	MQTTCommandPrefix = "oc2/cmd"
+	MQTTTopicAll      = "all"
+	MQTTTopicProfile  = "ap"
+	MQTTTopicDevice   = "device"
+	MQTTTopicGroup    = "group"
+)
+
+// mqttTopicLevel replaces characters which have special meaning in MQTT topics
+func mqttTopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+// MQTTCommandTopic returns topic the command is published to
+func MQTTCommandTopic(prefix string, cmd *OpenC2Command) string {
+	profiles := cmd.Actuator.Profiles()
+	if len(profiles) == 0 {
+		return prefix + "/" + MQTTTopicAll
+	}
+	profile := profiles[0]
+	if specifiers := cmd.Actuator.SLPF(); specifiers != nil && profile == SLPFNamespace {
+		if specifiers.AssetID != "" {
+			return prefix + "/" + MQTTTopicDevice + "/" + mqttTopicLevel(specifiers.AssetID)
+		}
+		if specifiers.NamedGroup != "" {
+			return prefix + "/" + MQTTTopicGroup + "/" + mqttTopicLevel(specifiers.NamedGroup)
+		}
+	}
+	return prefix + "/" + MQTTTopicProfile + "/" + mqttTopicLevel(profile)
+}
+
+// MQTTAssetTopics returns topics an asset with given profiles and named groups subscribes to
+func MQTTAssetTopics(prefix, assetID string, profiles, groups []string) []string {
+	topics := []string{prefix + "/" + MQTTTopicAll}
+	for _, profile := range profiles {
+		topics = append(topics, prefix+"/"+MQTTTopicProfile+"/"+mqttTopicLevel(profile))
+	}
+	if assetID != "" {
+		topics = append(topics, prefix+"/"+MQTTTopicDevice+"/"+mqttTopicLevel(assetID))
+	}
+	for _, group := range groups {
+		topics = append(topics, prefix+"/"+MQTTTopicGroup+"/"+mqttTopicLevel(group))
+	}
+	return topics
+}
@@ -2,11 +2,17 @@ package openc2
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var InvalidArgsError = errors.New("Invalid command arguments")
+
 type OpenC2Status int
 
 const (
@@ -34,6 +40,15 @@ func (r *OpenC2Response) AddResults(name string, data interface{}) {
 	r.Results[name] = data
 }
 
+type OpenC2ResponseRequested string
+
+const (
+	ResponseRequestedNone     OpenC2ResponseRequested = "none"
+	ResponseRequestedAck      OpenC2ResponseRequested = "ack"
+	ResponseRequestedStatus   OpenC2ResponseRequested = "status"
+	ResponseRequestedComplete OpenC2ResponseRequested = "complete"
+)
+
 type OpenC2Action string
 
 const (
@@ -83,19 +98,231 @@ const (
 )
 
 type OpenC2Command struct {
-	Action   OpenC2Action `json:"action"`
-	Target   interface{}  `json:"target"`
-	ID       string       `json:"id,omitempty"`
-	Args     interface{}  `json:"args,omitempty"`
-	Actuator interface{}  `json:"actuator,omitempty"`
+	Action   OpenC2Action              `json:"action"`
+	Target   OpenC2Target              `json:"target"`
+	ID       string                    `json:"id,omitempty"`
+	Args     *OpenC2Args               `json:"args,omitempty"`
+	Actuator *OpenC2ActuatorSpecifiers `json:"actuator,omitempty"`
+}
+
+// OpenC2Args are arguments of the command. Times and duration are in milliseconds. Extensions are args of actuator
+// profiles by namespace, decoded by the registered profile, ex. *SLPFArgs for "slpf".
+type OpenC2Args struct {
+	StartTime         *int64                  `json:"start_time,omitempty"`
+	StopTime          *int64                  `json:"stop_time,omitempty"`
+	Duration          *int64                  `json:"duration,omitempty"`
+	ResponseRequested OpenC2ResponseRequested `json:"response_requested,omitempty"`
+	Extensions        map[string]interface{}  `json:"-"`
+}
+
+func (a *OpenC2Args) MarshalJSON() ([]byte, error) {
+	type A OpenC2Args
+	extensions, err := encodeProfileMembers("args", a.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	return marshalWithExtensions((*A)(a), extensions)
+}
+
+func (a *OpenC2Args) UnmarshalJSON(b []byte) error {
+	type A OpenC2Args
+	if err := json.Unmarshal(b, (*A)(a)); err != nil {
+		return validationError("args", err)
+	}
+	members, err := extensionMembers(b, "start_time", "stop_time", "duration", "response_requested")
+	if err != nil {
+		return err
+	}
+	a.Extensions, err = decodeProfileMembers("args", members)
+	return err
+}
+
+// OpenC2ActuatorSpecifiers select actuators to execute the command. Specifiers are keyed by actuator profile
+// namespace and decoded by the registered profile, ex. *SLPFActuator for "slpf".
+type OpenC2ActuatorSpecifiers struct {
+	Specifiers map[string]interface{}
+}
+
+func (a *OpenC2ActuatorSpecifiers) MarshalJSON() ([]byte, error) {
+	members, err := encodeProfileMembers("actuator", a.Specifiers)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+func (a *OpenC2ActuatorSpecifiers) UnmarshalJSON(b []byte) error {
+	members, err := extensionMembers(b)
+	if err != nil {
+		return err
+	}
+	a.Specifiers, err = decodeProfileMembers("actuator", members)
+	return err
+}
+
+// Profiles returns sorted names of profiles with specifiers, none means the command is for all actuators
+func (a *OpenC2ActuatorSpecifiers) Profiles() []string {
+	if a == nil {
+		return nil
+	}
+	var profiles []string
+	for profile := range a.Specifiers {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	return profiles
 }
 
+// extensionMembers returns members of JSON object b with names not in known
+func extensionMembers(b []byte, known ...string) (map[string]json.RawMessage, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return nil, err
+	}
+	for _, name := range known {
+		delete(members, name)
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+	return members, nil
+}
+
+// marshalWithExtensions marshals struct v to JSON object with extensions added as members
+func marshalWithExtensions(v interface{}, extensions map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extensions) == 0 {
+		return data, err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	for name, value := range extensions {
+		members[name] = value
+	}
+	return json.Marshal(members)
+}
+
+// TargetIPConnection is 5-tuple of ipv4_connection and ipv6_connection targets. Port ranges and ICMPType (name of
+// ICMP type like "echo-request", with protocol "icmp") are extensions of OpenC2.
 type TargetIPConnection struct {
 	Protocol           string `json:"protocol,omitempty"`
 	SourceAddress      string `json:"src_addr,omitempty"`
-	SourcePort         int    `json:"src_port,omitempty"`
+	SourcePort         Ports  `json:"src_port,omitempty"`
 	DestinationAddress string `json:"dst_addr,omitempty"`
-	DestinationPort    int    `json:"dst_port,omitempty"`
+	DestinationPort    Ports  `json:"dst_port,omitempty"`
+	ICMPType           string `json:"icmp_type,omitempty"`
+}
+
+// PortRange is range of ports from First to Last, a single port if they are equal
+type PortRange struct {
+	First int
+	Last  int
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// ParsePortRange parses port number or "first-last" range
+func ParsePortRange(s string) (r PortRange, err error) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	if r.First, err = strconv.Atoi(strings.TrimSpace(first)); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %#v", s)
+	}
+	if r.Last, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %#v", s)
+	}
+	if r.First < 0 || r.Last > 65535 || r.First > r.Last {
+		return PortRange{}, fmt.Errorf("invalid port range %#v", s)
+	}
+	return r, nil
+}
+
+// Ports is a list of ports and port ranges of a connection target. In JSON it is a port number, a "first-last"
+// range string or an array of them, single port is marshalled as a number like in plain OpenC2.
+type Ports []PortRange
+
+func (p Ports) String() string {
+	ranges := make([]string, len(p))
+	for i, r := range p {
+		ranges[i] = r.String()
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Contains returns true if port is in one of the ranges
+func (p Ports) Contains(port int) bool {
+	for _, r := range p {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func portRangeJSON(r PortRange) interface{} {
+	if r.First == r.Last {
+		return r.First
+	}
+	return r.String()
+}
+
+func (p Ports) MarshalJSON() ([]byte, error) {
+	if len(p) == 1 {
+		return json.Marshal(portRangeJSON(p[0]))
+	}
+	ranges := make([]interface{}, len(p))
+	for i, r := range p {
+		ranges[i] = portRangeJSON(r)
+	}
+	return json.Marshal(ranges)
+}
+
+func (p *Ports) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	ports := make(Ports, 0, len(values))
+	for _, v := range values {
+		switch port := v.(type) {
+		case float64:
+			r, err := ParsePortRange(strconv.FormatFloat(port, 'f', -1, 64))
+			if err != nil {
+				return err
+			}
+			ports = append(ports, r)
+		case string:
+			r, err := ParsePortRange(port)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, r)
+		default:
+			return fmt.Errorf("invalid port %#v", v)
+		}
+	}
+	*p = ports
+	return nil
 }
 
 type TargetIPv4Connection struct{ TargetIPConnection }
@@ -104,8 +331,61 @@ type TargetIPv6Connection struct{ TargetIPConnection }
 type TargetIPv4Net string
 type TargetIPv6Net string
 
+// OpenC2GenericTarget is target of unknown type, with value as unmarshalled to interface{}
 type OpenC2GenericTarget map[OpenC2TargetType]interface{}
 
+// ResponseRequested returns args.response_requested of the command, or empty string if not set
+func (c *OpenC2Command) ResponseRequested() OpenC2ResponseRequested {
+	if c.Args == nil {
+		return ""
+	}
+	return c.Args.ResponseRequested
+}
+
+func millisToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// TemporalArgs returns start and stop times from args.start_time, args.stop_time and args.duration.
+// Zero start means "now", zero stop means "until deleted".
+func (c *OpenC2Command) TemporalArgs() (start, stop time.Time, err error) {
+	args := c.Args
+	if args == nil {
+		return
+	}
+	for _, arg := range []struct {
+		ms  *int64
+		dst *time.Time
+	}{{args.StartTime, &start}, {args.StopTime, &stop}} {
+		if arg.ms != nil {
+			if *arg.ms < 0 {
+				return time.Time{}, time.Time{}, InvalidArgsError
+			}
+			*arg.dst = millisToTime(*arg.ms)
+		}
+	}
+	if args.Duration != nil {
+		if *args.Duration < 0 {
+			return time.Time{}, time.Time{}, InvalidArgsError
+		}
+		duration := time.Duration(*args.Duration) * time.Millisecond
+		if !stop.IsZero() {
+			if !start.IsZero() {
+				return time.Time{}, time.Time{}, InvalidArgsError
+			}
+			start = stop.Add(-duration)
+		} else if start.IsZero() {
+			stop = time.Now().Add(duration)
+		} else {
+			stop = start.Add(duration)
+		}
+	}
+	if !start.IsZero() && !stop.IsZero() && stop.Before(start) {
+		return time.Time{}, time.Time{}, InvalidArgsError
+	}
+	return
+}
+
 func (c *OpenC2Command) MarshalJSON() ([]byte, error) {
 	type F OpenC2Command
 	out := &struct {
@@ -113,21 +393,22 @@ func (c *OpenC2Command) MarshalJSON() ([]byte, error) {
 		*F
 	}{F: (*F)(c)}
 	switch tgt := c.Target.(type) {
-	case *TargetIPv4Connection:
-		out.Target = map[OpenC2TargetType]interface{}{TargetTypeIPv4Connection: tgt}
-	case *TargetIPv6Connection:
-		out.Target = map[OpenC2TargetType]interface{}{TargetTypeIPv6Connection: tgt}
-	case *TargetIPv4Net:
-		out.Target = map[OpenC2TargetType]interface{}{TargetTypeIPv4Net: tgt}
-	case *TargetIPv6Net:
-		out.Target = map[OpenC2TargetType]interface{}{TargetTypeIPv6Net: tgt}
-	default:
-		out.Target = c.Target
+	case nil:
+	case OpenC2GenericTarget:
+		out.Target = tgt
 		log.Printf("Serializing unknown target: %#v", c.Target)
+	default:
+		value, err := marshalTarget(tgt)
+		if err != nil {
+			return nil, err
+		}
+		out.Target = map[OpenC2TargetType]json.RawMessage{tgt.TargetType(): value}
 	}
 	return json.Marshal(out)
 }
 
+// UnmarshalJSON decodes command with exactly one target of the language or a registered profile, and validates it.
+// Invalid commands return *ValidationError, ones using unregistered profiles *UnknownProfileError.
 func (c *OpenC2Command) UnmarshalJSON(b []byte) error {
 	type X OpenC2Command
 	x := &struct {
@@ -135,48 +416,29 @@ func (c *OpenC2Command) UnmarshalJSON(b []byte) error {
 		*X
 	}{X: (*X)(c)}
 	if err := json.Unmarshal(b, &x); err != nil {
-		return err
+		return validationError("", err)
 	}
 	tgt := make(map[OpenC2TargetType]json.RawMessage)
+	if len(x.Target) == 0 || string(x.Target) == "null" {
+		return &ValidationError{Field: "target", Reason: "missing"}
+	}
 	if err := json.Unmarshal(x.Target, &tgt); err != nil {
 		log.Printf("Could not unmarshal target to map[string]json.RawMessage")
-		return fmt.Errorf("%s", err)
+		return &ValidationError{Field: "target", Reason: "must be an object"}
 	}
-	if ipv4conn, ok := tgt[TargetTypeIPv4Connection]; ok {
-		log.Print("Target is IPv4 connection")
-		c.Target = &TargetIPv4Connection{}
-		if err := json.Unmarshal(ipv4conn, &c.Target); err != nil {
-			return err
-		}
-	} else if ipv6conn, ok := tgt[TargetTypeIPv6Connection]; ok {
-		log.Print("Target is IPv6 connection")
-		c.Target = &TargetIPv6Connection{}
-		if err := json.Unmarshal(ipv6conn, &c.Target); err != nil {
-			return err
-		}
-	} else if ipv4net, ok := tgt[TargetTypeIPv4Net]; ok {
-		log.Print("Target is IPv4 net")
-		c.Target = new(TargetIPv4Net)
-		if err := json.Unmarshal(ipv4net, &c.Target); err != nil {
-			return err
-		}
-	} else if ipv6net, ok := tgt[TargetTypeIPv6Net]; ok {
-		log.Print("Target is IPv6 net")
-		c.Target = new(TargetIPv6Net)
-		if err := json.Unmarshal(ipv6net, &c.Target); err != nil {
+	if len(tgt) != 1 {
+		return &ValidationError{Field: "target", Reason: fmt.Sprintf("must have exactly one member, has %d", len(tgt))}
+	}
+	for targetType, data := range tgt {
+		log.Printf("Target is %s", targetType)
+		target, err := unmarshalTarget(targetType, data)
+		if err != nil {
 			return err
 		}
-	} else {
-		log.Printf("Target type unknown: keys=%#v", reflect.ValueOf(tgt).MapKeys())
-		unknownTarget := make(OpenC2GenericTarget)
-		for key, rawValue := range tgt {
-			var parsedValue interface{}
-			if err := json.Unmarshal(rawValue, &parsedValue); err != nil {
-				return err
-			}
-			unknownTarget[key] = parsedValue
-		}
-		c.Target = unknownTarget
+		c.Target = target
+	}
+	if err := c.Validate(); err != nil {
+		return err
 	}
 	log.Printf("Unmarshalled: %#v", c)
 	return nil
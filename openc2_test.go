@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"log"
 	"path"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"encoding/json"
 
@@ -101,3 +103,295 @@ func TestResults(t *testing.T) {
 		}
 	}
 }
+
+func TestTemporalArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args        string
+		start, stop int64
+		fail        bool
+	}{
+		{args: `{}`},
+		{args: `{"start_time": 1000, "duration": 500}`, start: 1000, stop: 1500},
+		{args: `{"stop_time": 2000, "duration": 500}`, start: 1500, stop: 2000},
+		{args: `{"start_time": 1000, "stop_time": 2000}`, start: 1000, stop: 2000},
+		{args: `{"start_time": 1000, "stop_time": 2000, "duration": 500}`, fail: true},
+		{args: `{"start_time": 2000, "stop_time": 1000}`, fail: true},
+		{args: `{"start_time": "now"}`, fail: true},
+	} {
+		cmd := OpenC2Command{}
+		err := json.Unmarshal([]byte(tc.args), &cmd.Args)
+		if err != nil && !tc.fail {
+			t.Fatalf("Cannot parse %s: %s", tc.args, err)
+		}
+		var start, stop time.Time
+		if err == nil {
+			start, stop, err = cmd.TemporalArgs()
+		}
+		if tc.fail {
+			if err == nil {
+				t.Errorf("Expected error for %s", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tc.args, err)
+			continue
+		}
+		if tc.start != 0 && start.UnixNano()/1e6 != tc.start || tc.start == 0 && !start.IsZero() {
+			t.Errorf("Wrong start for %s: %s", tc.args, start)
+		}
+		if tc.stop != 0 && stop.UnixNano()/1e6 != tc.stop || tc.stop == 0 && !stop.IsZero() {
+			t.Errorf("Wrong stop for %s: %s", tc.args, stop)
+		}
+	}
+}
+
+func TestMQTTCommandTopic(t *testing.T) {
+	for _, tc := range []struct {
+		actuator string
+		topic    string
+	}{
+		{actuator: `null`, topic: "oc2/cmd/all"},
+		{actuator: `{}`, topic: "oc2/cmd/all"},
+		{actuator: `{"slpf": {}}`, topic: "oc2/cmd/ap/slpf"},
+		{actuator: `{"slpf": {"asset_id": "fw1"}}`, topic: "oc2/cmd/device/fw1"},
+		{actuator: `{"slpf": {"asset_id": "a/b+#"}}`, topic: "oc2/cmd/device/a_b__"},
+		{actuator: `{"slpf": {"named_group": "dmz"}}`, topic: "oc2/cmd/group/dmz"},
+		{actuator: `{"slpf": {"asset_tuple": ["x"]}}`, topic: "oc2/cmd/ap/slpf"},
+	} {
+		cmd := OpenC2Command{}
+		if err := json.Unmarshal([]byte(tc.actuator), &cmd.Actuator); err != nil {
+			t.Fatalf("Cannot parse %s: %s", tc.actuator, err)
+		}
+		if topic := MQTTCommandTopic(MQTTCommandPrefix, &cmd); topic != tc.topic {
+			t.Errorf("Wrong topic for %s: %#v, expected %#v", tc.actuator, topic, tc.topic)
+		}
+	}
+	topics := MQTTAssetTopics(MQTTCommandPrefix, "fw1", []string{"slpf"}, []string{"dmz"})
+	expected := []string{"oc2/cmd/all", "oc2/cmd/ap/slpf", "oc2/cmd/device/fw1", "oc2/cmd/group/dmz"}
+	if strings.Join(topics, " ") != strings.Join(expected, " ") {
+		t.Errorf("Wrong asset topics: %#v", topics)
+	}
+}
+
+func TestPorts(t *testing.T) {
+	for _, tc := range []struct {
+		json   string
+		ports  string
+		output string
+		fail   bool
+	}{
+		{json: `22`, ports: "22", output: `22`},
+		{json: `"6000-6010"`, ports: "6000-6010", output: `"6000-6010"`},
+		{json: `[22, "6000-6010"]`, ports: "22,6000-6010", output: `[22,"6000-6010"]`},
+		{json: `["80"]`, ports: "80", output: `80`},
+		{json: `"6010-6000"`, fail: true},
+		{json: `70000`, fail: true},
+		{json: `22.5`, fail: true},
+		{json: `[true]`, fail: true},
+	} {
+		var ports Ports
+		err := json.Unmarshal([]byte(tc.json), &ports)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("Expected error for %s, got %s", tc.json, ports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", tc.json, err)
+			continue
+		}
+		if ports.String() != tc.ports {
+			t.Errorf("Wrong ports for %s: %s", tc.json, ports)
+		}
+		if output, err := json.Marshal(ports); err != nil || string(output) != tc.output {
+			t.Errorf("Wrong JSON for %s: %s (%v)", tc.json, output, err)
+		}
+	}
+}
+
+func TestTypedCommand(t *testing.T) {
+	// targets of the language used by no registered profile are only valid with pairs of some profile
+	err := RegisterProfile(&Profile{Namespace: "x-typed", Pairs: map[OpenC2Action][]OpenC2TargetType{
+		ActionDeny:    {TargetTypeDomainName, TargetTypeMacAddr},
+		ActionContain: {TargetTypeDevice},
+		ActionStop:    {TargetTypeProcess},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pairs must not relax validation in other tests
+	t.Cleanup(func() { unregisterProfile("x-typed") })
+	for _, tc := range []struct {
+		json   string
+		target interface{}
+	}{
+		{json: `{"action":"query","target":{"features":[]}}`, target: &TargetFeatures{}},
+		{json: `{"action":"query","target":{"properties":["rules"]}}`, target: &TargetProperties{}},
+		{json: `{"action":"delete","target":{"slpf:rule_number":5}}`, target: new(TargetSLPFRuleNumber)},
+		{json: `{"action":"deny","target":{"domain_name":"example.com"}}`, target: new(TargetDomainName)},
+		{json: `{"action":"deny","target":{"mac_addr":"00:11:22:33:44:55"}}`, target: new(TargetMacAddr)},
+		{json: `{"action":"contain","target":{"device":{"hostname":"pc1"}}}`, target: &TargetDevice{}},
+		{json: `{"action":"stop","target":{"process":{"pid":42,"executable":{"name":"sh"}}}}`, target: &TargetProcess{}},
+		{json: `{"action":"update","target":{"file":{"name":"rules.json","hashes":{"sha256":"00ff"}}}}`, target: &TargetFile{}},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},` +
+			`"args":{"duration":1000,"slpf":{"insert_rule":3}},` +
+			`"actuator":{"slpf":{"asset_tuple":["a","b"]}}}`, target: new(TargetIPv4Net)},
+		{json: `{"action":"deny","target":{"x_widget":{"id":1}}}`},
+		{json: `{"action":"deny","target":{"x-acme:widget":{"id":1}}}`},
+		{json: `{"action":"deny","target":{"slpf:widget":{"id":1}}}`},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},"args":{"x-acme":{"foo":1}}}`},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},"actuator":{"x-acme":{}}}`},
+	} {
+		var cmd OpenC2Command
+		err = json.Unmarshal([]byte(tc.json), &cmd)
+		if tc.target == nil {
+			if err == nil {
+				t.Errorf("Expected error for %s", tc.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", tc.json, err)
+			continue
+		}
+		if reflect.TypeOf(cmd.Target) != reflect.TypeOf(tc.target) {
+			t.Errorf("Wrong target type for %s: %T", tc.json, cmd.Target)
+		}
+		output, err := json.Marshal(&cmd)
+		if err != nil {
+			t.Errorf("Cannot marshal %s: %s", tc.json, err)
+			continue
+		}
+		var expected, actual interface{}
+		json.Unmarshal([]byte(tc.json), &expected)
+		json.Unmarshal(output, &actual)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Wrong JSON for %s: %s", tc.json, output)
+		}
+	}
+	var cmd OpenC2Command
+	json.Unmarshal([]byte(`{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},"args":{"slpf":{"insert_rule":3}},`+
+		`"actuator":{"slpf":{"named_group":"dmz"}}}`), &cmd)
+	if *cmd.Args.SLPF().InsertRule != 3 || cmd.Actuator.SLPF().NamedGroup != "dmz" ||
+		strings.Join(cmd.Actuator.Profiles(), " ") != "slpf" {
+		t.Errorf("Wrong args or actuator: %#v, %#v", cmd.Args.SLPF(), cmd.Actuator)
+	}
+}
+
+// unregisterProfile removes profile registered by a test, so that tests leave the registry as they found it
+func unregisterProfile(namespace string) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	delete(registeredProfiles, namespace)
+}
+
+type testProfileTarget struct {
+	Name string `json:"name"`
+}
+
+func (testProfileTarget) TargetType() OpenC2TargetType { return "x-test:thing" }
+
+func TestRegisterProfile(t *testing.T) {
+	profile := &Profile{
+		Namespace: "x-test",
+		Targets: map[OpenC2TargetType]*ProfileCodec{
+			"x-test:thing": JSONCodec(func() interface{} { return &testProfileTarget{} }),
+		},
+		Args:  JSONCodec(func() interface{} { return &map[string]int{} }),
+		Pairs: map[OpenC2Action][]OpenC2TargetType{ActionDeny: {"x-test:thing"}},
+	}
+	if err := RegisterProfile(profile); err != nil {
+		t.Fatalf("Cannot register profile: %s", err)
+	}
+	t.Cleanup(func() { unregisterProfile("x-test") })
+	if err := RegisterProfile(profile); err == nil {
+		t.Error("Profile registered twice")
+	}
+	if err := RegisterProfile(&Profile{Namespace: "x-other", Targets: map[OpenC2TargetType]*ProfileCodec{"x-test:thing": nil}}); err == nil {
+		t.Error("Profile registered with target of another namespace")
+	}
+	if profiles := strings.Join(RegisteredProfiles(), " "); !strings.HasPrefix(profiles, "slpf ") || !strings.Contains(profiles, " x-test") {
+		t.Errorf("Wrong registered profiles: %s", profiles)
+	}
+	data := `{"action":"deny","target":{"x-test:thing":{"name":"a"}},"args":{"x-test":{"n":1}}}`
+	var cmd OpenC2Command
+	if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+		t.Fatalf("Cannot parse %s: %s", data, err)
+	}
+	if target, ok := cmd.Target.(*testProfileTarget); !ok || target.Name != "a" {
+		t.Errorf("Wrong profile target: %#v", cmd.Target)
+	}
+	if args, ok := cmd.Args.Extensions["x-test"].(*map[string]int); !ok || (*args)["n"] != 1 {
+		t.Errorf("Wrong profile args: %#v", cmd.Args.Extensions)
+	}
+	if output, err := json.Marshal(&cmd); err != nil || !strings.Contains(string(output), `"x-test":{"n":1}`) {
+		t.Errorf("Wrong JSON: %s (%v)", output, err)
+	}
+	data = `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},"actuator":{"x-test":{}}}`
+	if err := json.Unmarshal([]byte(data), &cmd); err == nil {
+		t.Errorf("Actuator specifiers accepted for profile without them: %s", data)
+	}
+	data = `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8"},"actuator":{"x-unknown":{}}}`
+	if err := json.Unmarshal([]byte(data), &cmd); err == nil {
+		t.Errorf("Unknown profile accepted: %s", data)
+	} else if profileErr, ok := err.(*UnknownProfileError); !ok || profileErr.Namespace != "x-unknown" {
+		t.Errorf("Wrong error for unknown profile: %#v", err)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	for _, tc := range []struct {
+		json  string
+		field string
+	}{
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.0/8","ipv6_net":"2001:db8::/32"}}`, field: "target"},
+		{json: `{"action":"deny","target":{}}`, field: "target"},
+		{json: `{"action":"deny"}`, field: "target"},
+		{json: `{"action":"deny","target":{"ipv4_netz":"10.0.0.0/8"}}`, field: "target"},
+		{json: `{"action":"block","target":{"ipv4_net":"10.0.0.0/8"}}`, field: "action"},
+		{json: `{"action":5,"target":{"ipv4_net":"10.0.0.0/8"}}`, field: "action"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.256"}}`, field: "target.ipv4_net"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.0/33"}}`, field: "target.ipv4_net"},
+		{json: `{"action":"deny","target":{"ipv4_net":"2001:db8::/32"}}`, field: "target.ipv4_net"},
+		{json: `{"action":"deny","target":{"ipv6_net":"10.0.0.0/8"}}`, field: "target.ipv6_net"},
+		{json: `{"action":"deny","target":{"ipv4_connection":{"src_addr":"example.com"}}}`, field: "target.ipv4_connection"},
+		{json: `{"action":"deny","target":{"ipv4_connection":{"dst_port":65536}}}`, field: "target.ipv4_connection"},
+		{json: `{"action":"deny","target":{"ipv4_connection":{"protocol":"gre"}}}`, field: "target.ipv4_connection"},
+		{json: `{"action":"deny","target":{"ipv6_connection":{}}}`, field: "target.ipv6_connection"},
+		{json: `{"action":"scan","target":{"ipv4_net":"10.0.0.0/8"}}`, field: "target"},
+		{json: `{"action":"deny","target":{"features":[]}}`, field: "target"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.1"},"args":{"start_time":"now"}}`, field: "args.start_time"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.1"},"args":{"duration":-1}}`, field: "args.duration"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.1"},"args":{"response_requested":"all"}}`, field: "args.response_requested"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.1"},"args":{"slpf":{"direction":"up"}}}`, field: "args.slpf"},
+		{json: `{"action":"deny","target":{"ipv4_net":"10.0.0.1"},"args":{"slpf":{"insert_rule":"1"}}}`, field: "args.slpf.insert_rule"},
+	} {
+		var cmd OpenC2Command
+		err := json.Unmarshal([]byte(tc.json), &cmd)
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("Expected validation error for %s, got %#v", tc.json, err)
+			continue
+		}
+		if validationErr.Field != tc.field {
+			t.Errorf("Wrong field of %s: %s", tc.json, validationErr)
+		}
+		if validationErr.Response().Status != StatusBadRequest {
+			t.Errorf("Wrong response for %s: %#v", tc.json, validationErr.Response())
+		}
+	}
+	for _, valid := range []string{
+		`{"action":"deny","target":{"ipv4_net":"10.0.0.1"}}`,
+		`{"action":"allow","target":{"ipv6_net":"2001:db8::1/128"}}`,
+		`{"action":"deny","target":{"ipv4_connection":{"protocol":"icmp","icmp_type":"echo-request"}}}`,
+		`{"action":"deny","target":{"ipv6_connection":{"src_addr":"::1","dst_port":"0-65535","protocol":"sctp"}}}`,
+		`{"action":"query","target":{"features":[]}}`,
+	} {
+		var cmd OpenC2Command
+		if err := json.Unmarshal([]byte(valid), &cmd); err != nil {
+			t.Errorf("Valid command %s rejected: %s", valid, err)
+		}
+	}
+}
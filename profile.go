@@ -0,0 +1,158 @@
+package openc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProfileCodec decodes JSON of a value defined by an actuator profile to a typed Go value and encodes it back
+type ProfileCodec struct {
+	Decode func(data []byte) (interface{}, error)
+	Encode func(value interface{}) ([]byte, error)
+}
+
+// JSONCodec returns codec unmarshalling into value returned by newValue, and marshalling with encoding/json
+func JSONCodec(newValue func() interface{}) *ProfileCodec {
+	return &ProfileCodec{
+		Decode: func(data []byte) (interface{}, error) {
+			value := newValue()
+			if err := json.Unmarshal(data, value); err != nil {
+				return nil, err
+			}
+			return value, nil
+		},
+		Encode: json.Marshal,
+	}
+}
+
+// Profile is an actuator profile extending the language with targets named "<namespace>:<name>", args.<namespace>
+// and actuator.<namespace> specifiers. Decoded targets must implement OpenC2Target, Args and Actuator are nil if the
+// profile defines none. Pairs are the action/target pairs the profile allows.
+type Profile struct {
+	Namespace string
+	Targets   map[OpenC2TargetType]*ProfileCodec
+	Args      *ProfileCodec
+	Actuator  *ProfileCodec
+	Pairs     map[OpenC2Action][]OpenC2TargetType
+}
+
+// UnknownProfileError is a target, args or actuator specifiers of a profile not registered
+type UnknownProfileError struct {
+	Namespace string
+	// Member is the command member it was found in: target, args or actuator
+	Member string
+}
+
+func (e *UnknownProfileError) Error() string {
+	return fmt.Sprintf("Unknown actuator profile %#v in %s", e.Namespace, e.Member)
+}
+
+var profileLock sync.RWMutex
+var registeredProfiles = make(map[string]*Profile)
+
+// RegisterProfile makes targets, args and actuator specifiers of the profile known to command (un)marshalling.
+// Namespace can be registered only once, and names of targets must be in it.
+func RegisterProfile(profile *Profile) error {
+	if profile.Namespace == "" || strings.Contains(profile.Namespace, ":") {
+		return fmt.Errorf("invalid profile namespace %#v", profile.Namespace)
+	}
+	for targetType := range profile.Targets {
+		if namespace, _ := splitTargetType(targetType); namespace != profile.Namespace {
+			return fmt.Errorf("target %#v not in namespace of profile %#v", targetType, profile.Namespace)
+		}
+	}
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	if _, ok := registeredProfiles[profile.Namespace]; ok {
+		return fmt.Errorf("profile %#v already registered", profile.Namespace)
+	}
+	registeredProfiles[profile.Namespace] = profile
+	return nil
+}
+
+// LookupProfile returns registered profile with the namespace, nil if there is none
+func LookupProfile(namespace string) *Profile {
+	profileLock.RLock()
+	defer profileLock.RUnlock()
+	return registeredProfiles[namespace]
+}
+
+// RegisteredProfiles returns sorted namespaces of registered profiles
+func RegisteredProfiles() []string {
+	profileLock.RLock()
+	defer profileLock.RUnlock()
+	namespaces := make([]string, 0, len(registeredProfiles))
+	for namespace := range registeredProfiles {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// splitTargetType splits "<namespace>:<name>" target type, namespace is empty for targets of the language itself
+func splitTargetType(targetType OpenC2TargetType) (namespace, name string) {
+	if i := strings.Index(string(targetType), ":"); i >= 0 {
+		return string(targetType[:i]), string(targetType[i+1:])
+	}
+	return "", string(targetType)
+}
+
+// profileCodec returns codec of profile member: target type or "args" or "actuator"
+func profileCodec(namespace, member string, targetType OpenC2TargetType) (*ProfileCodec, error) {
+	profile := LookupProfile(namespace)
+	if profile == nil {
+		return nil, &UnknownProfileError{Namespace: namespace, Member: member}
+	}
+	var codec *ProfileCodec
+	switch member {
+	case "target":
+		codec = profile.Targets[targetType]
+	case "args":
+		codec = profile.Args
+	case "actuator":
+		codec = profile.Actuator
+	}
+	if codec == nil {
+		if member == "target" {
+			return nil, &ValidationError{Field: member, Reason: fmt.Sprintf("profile %#v has no target %#v", namespace, targetType)}
+		}
+		return nil, &ValidationError{Field: member + "." + namespace, Reason: fmt.Sprintf("profile %#v has no %s", namespace, member)}
+	}
+	return codec, nil
+}
+
+// decodeProfileMembers decodes args or actuator members keyed by profile namespace
+func decodeProfileMembers(member string, members map[string]json.RawMessage) (map[string]interface{}, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]interface{}, len(members))
+	for namespace, data := range members {
+		codec, err := profileCodec(namespace, member, "")
+		if err != nil {
+			return nil, err
+		}
+		if values[namespace], err = codec.Decode(data); err != nil {
+			return nil, validationError(member+"."+namespace, err)
+		}
+	}
+	return values, nil
+}
+
+// encodeProfileMembers encodes args or actuator values keyed by profile namespace
+func encodeProfileMembers(member string, values map[string]interface{}) (map[string]json.RawMessage, error) {
+	members := make(map[string]json.RawMessage, len(values))
+	for namespace, value := range values {
+		codec, err := profileCodec(namespace, member, "")
+		if err != nil {
+			return nil, err
+		}
+		if members[namespace], err = codec.Encode(value); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,99 @@
+package openc2
+
+import "fmt"
+
+// Targets, arguments and actuator specifiers of the Stateless Packet Filtering (slpf) actuator profile
+
+const SLPFNamespace = "slpf"
+
+const TargetTypeSLPFRuleNumber OpenC2TargetType = SLPFNamespace + ":rule_number"
+
+// slpfRuleTargets are targets of allow and deny actions
+var slpfRuleTargets = []OpenC2TargetType{TargetTypeIPv4Net, TargetTypeIPv6Net, TargetTypeIPv4Connection, TargetTypeIPv6Connection}
+
+func init() {
+	err := RegisterProfile(&Profile{
+		Namespace: SLPFNamespace,
+		Targets: map[OpenC2TargetType]*ProfileCodec{
+			TargetTypeSLPFRuleNumber: JSONCodec(func() interface{} { return new(TargetSLPFRuleNumber) }),
+		},
+		Args:     JSONCodec(func() interface{} { return &SLPFArgs{} }),
+		Actuator: JSONCodec(func() interface{} { return &SLPFActuator{} }),
+		Pairs: map[OpenC2Action][]OpenC2TargetType{
+			ActionAllow:  slpfRuleTargets,
+			ActionDeny:   slpfRuleTargets,
+			ActionDelete: {TargetTypeSLPFRuleNumber},
+			ActionQuery:  {TargetTypeFeatures, TargetTypeProperties, TargetTypeSLPFRuleNumber},
+			ActionUpdate: {TargetTypeFile},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TargetSLPFRuleNumber is the rule number returned when rule was created
+type TargetSLPFRuleNumber float64
+
+func (TargetSLPFRuleNumber) TargetType() OpenC2TargetType { return TargetTypeSLPFRuleNumber }
+
+type SLPFDropProcess string
+
+const (
+	DropProcessNone     SLPFDropProcess = "none"
+	DropProcessReject   SLPFDropProcess = "reject"
+	DropProcessFalseAck SLPFDropProcess = "false_ack"
+)
+
+// SLPFArgs are args.slpf of a command. InsertRule is nil if rule number was not given.
+type SLPFArgs struct {
+	DropProcess SLPFDropProcess `json:"drop_process,omitempty"`
+	Persistent  bool            `json:"persistent,omitempty"`
+	Direction   string          `json:"direction,omitempty"`
+	InsertRule  *float64        `json:"insert_rule,omitempty"`
+}
+
+// SLPFActuator are actuator.slpf specifiers selecting the packet filters to execute the command
+type SLPFActuator struct {
+	Hostname   string   `json:"hostname,omitempty"`
+	NamedGroup string   `json:"named_group,omitempty"`
+	AssetID    string   `json:"asset_id,omitempty"`
+	AssetTuple []string `json:"asset_tuple,omitempty"`
+}
+
+// IsEmpty returns true if no specifiers are given, so command is for all packet filters
+func (a *SLPFActuator) IsEmpty() bool {
+	return a.Hostname == "" && a.NamedGroup == "" && a.AssetID == "" && a.AssetTuple == nil
+}
+
+// SLPF returns args.slpf of the command, nil if not given
+func (a *OpenC2Args) SLPF() *SLPFArgs {
+	if a == nil {
+		return nil
+	}
+	args, _ := a.Extensions[SLPFNamespace].(*SLPFArgs)
+	return args
+}
+
+// SLPF returns actuator.slpf specifiers of the command, nil if not given
+func (a *OpenC2ActuatorSpecifiers) SLPF() *SLPFActuator {
+	if a == nil {
+		return nil
+	}
+	specifiers, _ := a.Specifiers[SLPFNamespace].(*SLPFActuator)
+	return specifiers
+}
+
+func (a *SLPFArgs) Validate() error {
+	switch a.DropProcess {
+	case "", DropProcessNone, DropProcessReject, DropProcessFalseAck:
+	default:
+		return fmt.Errorf("unknown drop_process %#v", a.DropProcess)
+	}
+	switch a.Direction {
+	case "", "ingress", "egress", "both":
+	default:
+		return fmt.Errorf("unknown direction %#v", a.Direction)
+	}
+	return nil
+}
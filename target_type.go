@@ -0,0 +1,178 @@
+package openc2
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// OpenC2Target is the object of the action. Known target types are unmarshalled to pointers of Target* types,
+// other ones to OpenC2GenericTarget.
+type OpenC2Target interface {
+	TargetType() OpenC2TargetType
+}
+
+// Hashes are hex encoded cryptographic hashes of a file or artifact
+type Hashes struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Payload is content of an artifact, either base64 encoded in Bin or located at URL
+type Payload struct {
+	Bin string `json:"bin,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+type TargetArtifact struct {
+	MimeType string   `json:"mime_type,omitempty"`
+	Payload  *Payload `json:"payload,omitempty"`
+	Hashes   *Hashes  `json:"hashes,omitempty"`
+}
+
+// TargetCommand is ID of a previously issued command
+type TargetCommand string
+
+type TargetDevice struct {
+	Hostname    string `json:"hostname,omitempty"`
+	IDNHostname string `json:"idn_hostname,omitempty"`
+	DeviceID    string `json:"device_id,omitempty"`
+}
+
+type TargetDomainName string
+type TargetEmailAddr string
+
+type OpenC2Feature string
+
+const (
+	FeatureVersions  OpenC2Feature = "versions"
+	FeatureProfiles  OpenC2Feature = "profiles"
+	FeaturePairs     OpenC2Feature = "pairs"
+	FeatureRateLimit OpenC2Feature = "rate_limit"
+)
+
+// TargetFeatures lists results to return from query features, empty list only checks that actuator is alive
+type TargetFeatures []OpenC2Feature
+
+func (f TargetFeatures) MarshalJSON() ([]byte, error) {
+	if f == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]OpenC2Feature(f))
+}
+
+type TargetFile struct {
+	Name   string  `json:"name,omitempty"`
+	Path   string  `json:"path,omitempty"`
+	Hashes *Hashes `json:"hashes,omitempty"`
+}
+
+type TargetIdnDomainName string
+type TargetIdnEmailAddr string
+type TargetIri string
+type TargetMacAddr string
+
+type TargetProcess struct {
+	PID         int            `json:"pid,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	Cwd         string         `json:"cwd,omitempty"`
+	Executable  *TargetFile    `json:"executable,omitempty"`
+	Parent      *TargetProcess `json:"parent,omitempty"`
+	CommandLine string         `json:"command_line,omitempty"`
+}
+
+// TargetProperties lists names of actuator properties to query
+type TargetProperties []string
+
+type TargetURI string
+
+func (TargetArtifact) TargetType() OpenC2TargetType       { return TargetTypeArtifact }
+func (TargetCommand) TargetType() OpenC2TargetType        { return TargetTypeCommand }
+func (TargetDevice) TargetType() OpenC2TargetType         { return TargetTypeDevice }
+func (TargetDomainName) TargetType() OpenC2TargetType     { return TargetTypeDomainName }
+func (TargetEmailAddr) TargetType() OpenC2TargetType      { return TargetTypeEmailAddr }
+func (TargetFeatures) TargetType() OpenC2TargetType       { return TargetTypeFeatures }
+func (TargetFile) TargetType() OpenC2TargetType           { return TargetTypeFile }
+func (TargetIdnDomainName) TargetType() OpenC2TargetType  { return TargetTypeIdnDomainName }
+func (TargetIdnEmailAddr) TargetType() OpenC2TargetType   { return TargetTypeIdnEmailAddr }
+func (TargetIPv4Net) TargetType() OpenC2TargetType        { return TargetTypeIPv4Net }
+func (TargetIPv6Net) TargetType() OpenC2TargetType        { return TargetTypeIPv6Net }
+func (TargetIPv4Connection) TargetType() OpenC2TargetType { return TargetTypeIPv4Connection }
+func (TargetIPv6Connection) TargetType() OpenC2TargetType { return TargetTypeIPv6Connection }
+func (TargetIri) TargetType() OpenC2TargetType            { return TargetTypeIri }
+func (TargetMacAddr) TargetType() OpenC2TargetType        { return TargetTypeMacAddr }
+func (TargetProcess) TargetType() OpenC2TargetType        { return TargetTypeProcess }
+func (TargetProperties) TargetType() OpenC2TargetType     { return TargetTypeProperties }
+func (TargetURI) TargetType() OpenC2TargetType            { return TargetTypeURI }
+
+// TargetType returns type of the generic target if it has a single one
+func (t OpenC2GenericTarget) TargetType() OpenC2TargetType {
+	if len(t) != 1 {
+		return ""
+	}
+	for targetType := range t {
+		return targetType
+	}
+	return ""
+}
+
+// newTarget returns empty target of known type to unmarshal into
+var newTarget = map[OpenC2TargetType]func() OpenC2Target{
+	TargetTypeArtifact:       func() OpenC2Target { return &TargetArtifact{} },
+	TargetTypeCommand:        func() OpenC2Target { return new(TargetCommand) },
+	TargetTypeDevice:         func() OpenC2Target { return &TargetDevice{} },
+	TargetTypeDomainName:     func() OpenC2Target { return new(TargetDomainName) },
+	TargetTypeEmailAddr:      func() OpenC2Target { return new(TargetEmailAddr) },
+	TargetTypeFeatures:       func() OpenC2Target { return &TargetFeatures{} },
+	TargetTypeFile:           func() OpenC2Target { return &TargetFile{} },
+	TargetTypeIdnDomainName:  func() OpenC2Target { return new(TargetIdnDomainName) },
+	TargetTypeIdnEmailAddr:   func() OpenC2Target { return new(TargetIdnEmailAddr) },
+	TargetTypeIPv4Net:        func() OpenC2Target { return new(TargetIPv4Net) },
+	TargetTypeIPv6Net:        func() OpenC2Target { return new(TargetIPv6Net) },
+	TargetTypeIPv4Connection: func() OpenC2Target { return &TargetIPv4Connection{} },
+	TargetTypeIPv6Connection: func() OpenC2Target { return &TargetIPv6Connection{} },
+	TargetTypeIri:            func() OpenC2Target { return new(TargetIri) },
+	TargetTypeMacAddr:        func() OpenC2Target { return new(TargetMacAddr) },
+	TargetTypeProcess:        func() OpenC2Target { return &TargetProcess{} },
+	TargetTypeProperties:     func() OpenC2Target { return &TargetProperties{} },
+	TargetTypeURI:            func() OpenC2Target { return new(TargetURI) },
+}
+
+// unmarshalTarget unmarshals value of target of the language or a registered profile
+func unmarshalTarget(targetType OpenC2TargetType, data json.RawMessage) (OpenC2Target, error) {
+	if namespace, _ := splitTargetType(targetType); namespace != "" {
+		codec, err := profileCodec(namespace, "target", targetType)
+		if err != nil {
+			return nil, err
+		}
+		value, err := codec.Decode(data)
+		if err != nil {
+			return nil, validationError("target."+string(targetType), err)
+		}
+		target, ok := value.(OpenC2Target)
+		if !ok {
+			return nil, fmt.Errorf("%s target decoded to %T", targetType, value)
+		}
+		return target, nil
+	}
+	if newTarget[targetType] == nil {
+		return nil, &ValidationError{Field: "target", Reason: fmt.Sprintf("unknown target type %#v", targetType)}
+	}
+	target := newTarget[targetType]()
+	if err := json.Unmarshal(data, target); err != nil {
+		return nil, validationError("target."+string(targetType), err)
+	}
+	return target, nil
+}
+
+// marshalTarget marshals value of the target, with codec of its profile if it has a namespace
+func marshalTarget(target OpenC2Target) ([]byte, error) {
+	if namespace, _ := splitTargetType(target.TargetType()); namespace != "" {
+		codec, err := profileCodec(namespace, "target", target.TargetType())
+		if err != nil {
+			return nil, err
+		}
+		return codec.Encode(target)
+	}
+	return json.Marshal(target)
+}
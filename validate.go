@@ -0,0 +1,175 @@
+package openc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidationError is a command not conforming to OpenC2 language or its profiles, to be answered with 400
+type ValidationError struct {
+	// Field is path of the invalid member, ex. "target.ipv4_net"
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Field, e.Reason)
+}
+
+// Response returns Bad Request response explaining the error
+func (e *ValidationError) Response() OpenC2Response {
+	return OpenC2Response{Status: StatusBadRequest, StatusText: e.Error()}
+}
+
+// Validator is implemented by targets and args which can check their values beyond JSON types
+type Validator interface {
+	Validate() error
+}
+
+var actions = map[OpenC2Action]bool{
+	ActionScan: true, ActionLocate: true, ActionQuery: true, ActionDeny: true, ActionContain: true,
+	ActionAllow: true, ActionStart: true, ActionStop: true, ActionRestart: true, ActionCancel: true,
+	ActionSet: true, ActionUpdate: true, ActionRedirect: true, ActionCreate: true, ActionDelete: true,
+	ActionDetonate: true, ActionRestore: true, ActionCopy: true, ActionInvestigate: true, ActionRemediate: true,
+}
+
+// languagePairs are action/target pairs every actuator has to support
+var languagePairs = map[OpenC2Action][]OpenC2TargetType{ActionQuery: {TargetTypeFeatures}}
+
+// L4 protocols of connection targets
+var protocols = map[string]bool{"icmp": true, "tcp": true, "udp": true, "sctp": true}
+
+var responseTypes = map[OpenC2ResponseRequested]bool{
+	ResponseRequestedNone: true, ResponseRequestedAck: true, ResponseRequestedStatus: true, ResponseRequestedComplete: true,
+}
+
+// PairAllowed returns true if the target type can be used with the action by the language or a registered profile
+func PairAllowed(action OpenC2Action, targetType OpenC2TargetType) bool {
+	pairsList := [][]OpenC2TargetType{languagePairs[action]}
+	profileLock.RLock()
+	for _, profile := range registeredProfiles {
+		pairsList = append(pairsList, profile.Pairs[action])
+	}
+	profileLock.RUnlock()
+	for _, targetTypes := range pairsList {
+		for _, t := range targetTypes {
+			if t == targetType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate checks that action is known, target is valid and can be used with the action, and args have valid values
+func (c *OpenC2Command) Validate() error {
+	if !actions[c.Action] {
+		return &ValidationError{Field: "action", Reason: fmt.Sprintf("unknown action %#v", c.Action)}
+	}
+	if c.Target == nil {
+		return &ValidationError{Field: "target", Reason: "missing"}
+	}
+	targetType := c.Target.TargetType()
+	if generic, ok := c.Target.(OpenC2GenericTarget); ok && len(generic) != 1 {
+		return &ValidationError{Field: "target", Reason: fmt.Sprintf("must have exactly one member, has %d", len(generic))}
+	}
+	if validator, ok := c.Target.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return &ValidationError{Field: "target." + string(targetType), Reason: err.Error()}
+		}
+	}
+	if !PairAllowed(c.Action, targetType) {
+		return &ValidationError{Field: "target", Reason: fmt.Sprintf("%s can't be used with action %s", targetType, c.Action)}
+	}
+	if c.Args != nil {
+		if rr := c.Args.ResponseRequested; rr != "" && !responseTypes[rr] {
+			return &ValidationError{Field: "args.response_requested", Reason: fmt.Sprintf("unknown response type %#v", rr)}
+		}
+		for _, field := range []struct {
+			name  string
+			value *int64
+		}{{"start_time", c.Args.StartTime}, {"stop_time", c.Args.StopTime}, {"duration", c.Args.Duration}} {
+			if field.value != nil && *field.value < 0 {
+				return &ValidationError{Field: "args." + field.name, Reason: "must not be negative"}
+			}
+		}
+		for namespace, args := range c.Args.Extensions {
+			if validator, ok := args.(Validator); ok {
+				if err := validator.Validate(); err != nil {
+					return &ValidationError{Field: "args." + namespace, Reason: err.Error()}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateNet checks that address is an IPv4 or IPv6 address with optional prefix length
+func validateNet(address string, ipv6 bool) error {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	ip := net.ParseIP(address)
+	if strings.Contains(address, "/") {
+		var err error
+		if ip, _, err = net.ParseCIDR(address); err != nil {
+			ip = nil
+		}
+	}
+	if ip == nil || ipv6 != strings.Contains(address, ":") {
+		return fmt.Errorf("%#v is not %s address or CIDR", address, family)
+	}
+	return nil
+}
+
+func (t TargetIPv4Net) Validate() error {
+	return validateNet(string(t), false)
+}
+
+func (t TargetIPv6Net) Validate() error {
+	return validateNet(string(t), true)
+}
+
+// validate checks addresses of the connection, its protocol and that it's not empty
+func (t *TargetIPConnection) validate(ipv6 bool) error {
+	if t.Protocol == "" && t.SourceAddress == "" && t.DestinationAddress == "" && t.SourcePort == nil &&
+		t.DestinationPort == nil && t.ICMPType == "" {
+		return fmt.Errorf("no members")
+	}
+	for _, address := range []string{t.SourceAddress, t.DestinationAddress} {
+		if address != "" {
+			if err := validateNet(address, ipv6); err != nil {
+				return err
+			}
+		}
+	}
+	if t.Protocol != "" && !protocols[t.Protocol] {
+		return fmt.Errorf("unknown protocol %#v", t.Protocol)
+	}
+	return nil
+}
+
+func (t TargetIPv4Connection) Validate() error {
+	return t.validate(false)
+}
+
+func (t TargetIPv6Connection) Validate() error {
+	return t.validate(true)
+}
+
+// validationError converts JSON decoding error of field to ValidationError, keeping errors of unknown profiles
+func validationError(field string, err error) error {
+	switch e := err.(type) {
+	case nil, *ValidationError, *UnknownProfileError:
+		return err
+	case *json.UnmarshalTypeError:
+		if e.Field != "" {
+			field += "." + e.Field
+		}
+		return &ValidationError{Field: strings.TrimPrefix(field, "."), Reason: fmt.Sprintf("%s can't be %s", e.Value, e.Type)}
+	}
+	return &ValidationError{Field: field, Reason: err.Error()}
+}